@@ -0,0 +1,360 @@
+// Package api serves the txwifi REST API of an iotwifi.Service. The
+// txwifi binary mounts it at the root of its router, programs embedding
+// txwifi mount it under a path prefix of their own server.
+
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// Route groups selecting the mounted routes.
+const (
+	RouteStatus   = "status"   // GET /status
+	RouteConnect  = "connect"  // POST /connect
+	RouteScan     = "scan"     // GET /scan
+	RouteNetworks = "networks" // GET /networks, DELETE /networks/{network}
+	RouteAp       = "ap"       // /ap/status, /ap/config, /ap/enable, /ap/disable, /ap/clients
+	RouteConfig   = "config"   // GET /config, POST /config/reload
+	RouteLog      = "log"      // GET and PUT /log/level, requires WithLogLevels
+	RouteHealth   = "health"   // /healthz, /readyz, /health
+	RouteMetrics  = "metrics"  // GET /metrics
+	RouteEvents   = "events"   // GET /events
+	RouteReset    = "reset"    // POST /reset
+	RouteKill     = "kill"     // /kill
+)
+
+// Routes returns every route group.
+func Routes() []string {
+	return []string{
+		RouteStatus, RouteConnect, RouteScan, RouteNetworks, RouteAp, RouteConfig, RouteLog,
+		RouteHealth, RouteMetrics, RouteEvents, RouteReset, RouteKill,
+	}
+}
+
+// HTTP metrics recorded by the log middleware.
+var (
+	metricHttpRequests = iotwifi.NewCounter("txwifi_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	metricHttpDuration = iotwifi.NewHistogram("txwifi_http_request_duration_seconds",
+		"HTTP request latency by route.", nil, "route")
+)
+
+// ApiReturn structures a message for returned API calls.
+type ApiReturn struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message"`
+	Payload interface{} `json:"payload"`
+}
+
+// Api serves the REST API of a Service. It is an http.Handler with its
+// own router, or its routes are registered on another router with
+// Register.
+type Api struct {
+	svc    *iotwifi.Service
+	log    iotwifi.Logger
+	levels *iotwifi.LogLevels
+	prefix string
+	auth   func(http.Handler) http.Handler
+	routes map[string]bool
+
+	router *mux.Router
+}
+
+// Option configures an Api.
+type Option func(*Api)
+
+// WithLogger sets the logger of requests, the logger of the Service by
+// default.
+func WithLogger(log iotwifi.Logger) Option {
+	return func(a *Api) {
+		a.log = log
+	}
+}
+
+// WithLogLevels enables the /log/level routes changing levels.
+func WithLogLevels(levels *iotwifi.LogLevels) Option {
+	return func(a *Api) {
+		a.levels = levels
+	}
+}
+
+// WithPrefix mounts the routes under prefix, such as /wifi.
+func WithPrefix(prefix string) Option {
+	return func(a *Api) {
+		a.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithAuth wraps every route in an authentication middleware, which
+// rejects a request by writing a response without calling the next
+// handler. See BearerAuth and BasicAuth.
+func WithAuth(auth func(http.Handler) http.Handler) Option {
+	return func(a *Api) {
+		a.auth = auth
+	}
+}
+
+// WithRoutes mounts only the given route groups.
+func WithRoutes(groups ...string) Option {
+	return func(a *Api) {
+		a.routes = map[string]bool{}
+		for _, group := range groups {
+			a.routes[group] = true
+		}
+	}
+}
+
+// WithoutRoutes leaves out the given route groups, such as RouteKill
+// and RouteReset when the device is managed by an embedding program.
+func WithoutRoutes(groups ...string) Option {
+	return func(a *Api) {
+		for _, group := range groups {
+			delete(a.routes, group)
+		}
+	}
+}
+
+// New returns the API of svc, with every route group mounted at the root
+// unless configured otherwise.
+func New(svc *iotwifi.Service, opts ...Option) *Api {
+	a := &Api{
+		svc:    svc,
+		log:    svc.Log,
+		routes: map[string]bool{},
+	}
+	for _, group := range Routes() {
+		a.routes[group] = true
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	a.router = mux.NewRouter()
+	a.Register(a.router)
+
+	return a
+}
+
+// ServeHTTP serves the API routes, other paths are not found.
+func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
+}
+
+// Register adds the API routes to r under the prefix. Other routes of r
+// are left untouched, so r may serve an application of its own.
+func (a *Api) Register(r *mux.Router) {
+	routes := []struct {
+		group   string
+		path    string
+		handler http.HandlerFunc
+		methods []string
+	}{
+		{RouteStatus, "/status", a.status, nil},
+		{RouteConnect, "/connect", a.connect, []string{"POST"}},
+		{RouteScan, "/scan", a.scan, nil},
+		{RouteNetworks, "/networks", a.networks, []string{"GET"}},
+		{RouteNetworks, "/networks/{network}", a.networkForget, []string{"DELETE"}},
+		{RouteKill, "/kill", a.kill, nil},
+		{RouteReset, "/reset", a.reset, []string{"POST"}},
+		{RouteHealth, "/healthz", a.healthz, []string{"GET", "HEAD"}},
+		{RouteHealth, "/readyz", a.readyz, []string{"GET", "HEAD"}},
+		{RouteHealth, "/health", a.health, []string{"GET"}},
+		{RouteMetrics, "/metrics", a.metrics, []string{"GET"}},
+		{RouteEvents, "/events", a.events, []string{"GET"}},
+		{RouteConfig, "/config", a.config, []string{"GET"}},
+		{RouteConfig, "/config/reload", a.configReload, []string{"POST"}},
+		{RouteLog, "/log/level", a.logLevel, []string{"GET"}},
+		{RouteLog, "/log/level", a.logLevelSet, []string{"PUT"}},
+		{RouteAp, "/ap/status", a.apStatus, []string{"GET"}},
+		{RouteAp, "/ap/config", a.apConfig, []string{"PUT"}},
+		{RouteAp, "/ap/enable", a.apEnable, []string{"POST"}},
+		{RouteAp, "/ap/disable", a.apDisable, []string{"POST"}},
+		{RouteAp, "/ap/clients", a.apClients, []string{"GET"}},
+		{RouteAp, "/ap/clients/{mac}/deauth", a.apDeauth, []string{"POST"}},
+	}
+
+	for _, route := range routes {
+		if !a.routes[route.group] || (route.group == RouteLog && a.levels == nil) {
+			continue
+		}
+
+		var handler http.Handler = route.handler
+		if a.auth != nil {
+			handler = a.auth(handler)
+		}
+
+		rt := r.Handle(a.prefix+route.path, a.Logged(handler))
+		if route.methods != nil {
+			rt.Methods(route.methods...)
+		}
+	}
+}
+
+// responseRecorder captures the status code and body size written by a
+// handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader records the status code.
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the body size.
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush passes flushes through for streaming responses.
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// requestIdR limits propagated X-Request-ID values to safe characters.
+var requestIdR = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestId returns the X-Request-ID of a request or a new random id.
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); requestIdR.MatchString(id) {
+		return id
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Logged is the log middleware of the API routes, it assigns or
+// propagates X-Request-ID, records the HTTP metrics and logs the
+// response once the handler is done.
+func (a *Api) Logged(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := requestId(r)
+		w.Header().Set("X-Request-ID", id)
+
+		log := a.log.Child(map[string]interface{}{"req_id": id})
+		ctx := iotwifi.WithRequestId(r.Context(), id)
+		ctx = iotwifi.WithLogger(ctx, log)
+		r = r.WithContext(ctx)
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// label by route template to keep cardinality bounded
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		duration := time.Since(start)
+		metricHttpRequests.Inc(route, r.Method, strconv.Itoa(rec.status))
+		metricHttpDuration.Observe(duration.Seconds(), route)
+
+		staticFields := make(map[string]interface{})
+		staticFields["remote"] = r.RemoteAddr
+		staticFields["method"] = r.Method
+		staticFields["url"] = r.RequestURI
+		staticFields["route"] = route
+		staticFields["status"] = rec.status
+		staticFields["bytes"] = rec.bytes
+		staticFields["duration_ms"] = float64(duration.Nanoseconds()) / 1e6
+
+		if rec.status >= http.StatusInternalServerError {
+			log.Error(staticFields, "HTTP")
+			return
+		}
+		log.Info(staticFields, "HTTP")
+	})
+}
+
+// ReadOnly rejects requests that change the device with 403 Forbidden,
+// letting through GET, HEAD and OPTIONS requests other than /kill, for
+// listeners that may only observe.
+func (a *Api) ReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			if r.URL.Path != a.prefix+"/kill" {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		ret, _ := json.Marshal(&ApiReturn{
+			Status:  "FAIL",
+			Message: "read-only listener",
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(ret)
+	})
+}
+
+// unauthorized rejects a request with 401 Unauthorized.
+func unauthorized(w http.ResponseWriter, challenge string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// equal compares secrets in constant time.
+func equal(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// BearerAuth returns a WithAuth middleware accepting requests with the
+// header "Authorization: Bearer <token>".
+func BearerAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || !equal(strings.TrimPrefix(auth, "Bearer "), token) {
+				unauthorized(w, `Bearer realm="txwifi"`)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BasicAuth returns a WithAuth middleware accepting requests with HTTP
+// basic authentication as user.
+func BasicAuth(user string, password string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			// evaluate both to not leak which one is wrong
+			userOk, passwordOk := equal(u, user), equal(p, password)
+			if !ok || !userOk || !passwordOk {
+				unauthorized(w, `Basic realm="txwifi"`)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
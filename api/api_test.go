@@ -0,0 +1,168 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// newApi returns the API of a service that was not started.
+func newApi(opts ...Option) *Api {
+	return New(iotwifi.NewService(nil, &iotwifi.SetupCfg{}), opts...)
+}
+
+// serve returns the status code of a request to h.
+func serve(h http.Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		auth      func(http.Handler) http.Handler
+		header    string
+		user      string
+		password  string
+		code      int
+		challenge string
+	}{
+		{name: "bearer", auth: BearerAuth("secret"), header: "Bearer secret", code: 200},
+		{name: "bearer missing", auth: BearerAuth("secret"), code: 401, challenge: `Bearer realm="txwifi"`},
+		{name: "bearer wrong token", auth: BearerAuth("secret"), header: "Bearer secrets", code: 401, challenge: `Bearer realm="txwifi"`},
+		{name: "bearer wrong scheme", auth: BearerAuth("secret"), header: "Token secret", code: 401, challenge: `Bearer realm="txwifi"`},
+		{name: "bearer empty token", auth: BearerAuth("secret"), header: "Bearer ", code: 401, challenge: `Bearer realm="txwifi"`},
+		{name: "basic", auth: BasicAuth("admin", "secret"), user: "admin", password: "secret", code: 200},
+		{name: "basic missing", auth: BasicAuth("admin", "secret"), code: 401, challenge: `Basic realm="txwifi"`},
+		{name: "basic wrong user", auth: BasicAuth("admin", "secret"), user: "root", password: "secret", code: 401, challenge: `Basic realm="txwifi"`},
+		{name: "basic wrong password", auth: BasicAuth("admin", "secret"), user: "admin", password: "Secret", code: 401, challenge: `Basic realm="txwifi"`},
+		{name: "basic as bearer", auth: BasicAuth("admin", "secret"), header: "Bearer secret", code: 401, challenge: `Basic realm="txwifi"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newApi(WithAuth(tt.auth))
+
+			r := httptest.NewRequest("GET", "/healthz", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Errorf("got %d, want %d", w.Code, tt.code)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != tt.challenge {
+				t.Errorf("got challenge %q, want %q", challenge, tt.challenge)
+			}
+		})
+	}
+}
+
+// logLevels returns the default log levels.
+func logLevels(t *testing.T) *iotwifi.LogLevels {
+	levels, err := iotwifi.NewLogLevels(iotwifi.LogCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return levels
+}
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		method string
+		path   string
+		code   int
+	}{
+		{name: "all", method: "GET", path: "/healthz", code: 200},
+		{name: "all config", method: "GET", path: "/config", code: 200},
+		{name: "wrong method", method: "POST", path: "/healthz", code: 405},
+		{name: "log without levels", method: "GET", path: "/log/level", code: 404},
+		{name: "log with levels", opts: []Option{WithLogLevels(logLevels(t))}, method: "GET", path: "/log/level", code: 200},
+		{name: "with routes", opts: []Option{WithRoutes(RouteHealth)}, method: "GET", path: "/healthz", code: 200},
+		{name: "with routes others", opts: []Option{WithRoutes(RouteHealth)}, method: "GET", path: "/config", code: 404},
+		{name: "without routes", opts: []Option{WithoutRoutes(RouteKill, RouteReset)}, method: "GET", path: "/kill", code: 404},
+		{name: "without routes reset", opts: []Option{WithoutRoutes(RouteKill, RouteReset)}, method: "POST", path: "/reset", code: 404},
+		{name: "without routes others", opts: []Option{WithoutRoutes(RouteKill, RouteReset)}, method: "GET", path: "/config", code: 200},
+		{name: "with and without routes", opts: []Option{WithRoutes(RouteHealth, RouteConfig), WithoutRoutes(RouteConfig)}, method: "GET", path: "/config", code: 404},
+		{name: "prefix", opts: []Option{WithPrefix("/wifi")}, method: "GET", path: "/wifi/healthz", code: 200},
+		{name: "prefix trailing slash", opts: []Option{WithPrefix("/wifi/")}, method: "GET", path: "/wifi/healthz", code: 200},
+		{name: "prefix root", opts: []Option{WithPrefix("/wifi")}, method: "GET", path: "/healthz", code: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newApi(tt.opts...)
+
+			if code := serve(a, httptest.NewRequest(tt.method, tt.path, nil)); code != tt.code {
+				t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	newApi(WithPrefix("/wifi"), WithRoutes(RouteHealth)).Register(r)
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{path: "/", code: http.StatusTeapot},
+		{path: "/wifi/healthz", code: 200},
+		{path: "/wifi/config", code: 404},
+	}
+
+	for _, tt := range tests {
+		if code := serve(r, httptest.NewRequest("GET", tt.path, nil)); code != tt.code {
+			t.Errorf("GET %s: got %d, want %d", tt.path, code, tt.code)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{method: "GET", path: "/wifi/status", code: 200},
+		{method: "HEAD", path: "/wifi/healthz", code: 200},
+		{method: "OPTIONS", path: "/wifi/connect", code: 200},
+		{method: "GET", path: "/wifi/kill", code: 403},
+		{method: "HEAD", path: "/wifi/kill", code: 403},
+		{method: "POST", path: "/wifi/connect", code: 403},
+		{method: "POST", path: "/wifi/reset", code: 403},
+		{method: "PUT", path: "/wifi/ap/config", code: 403},
+		{method: "DELETE", path: "/wifi/networks/0", code: 403},
+		{method: "POST", path: "/wifi/status", code: 403},
+	}
+
+	a := newApi(WithPrefix("/wifi"))
+	readOnly := a.ReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if code := serve(readOnly, httptest.NewRequest(tt.method, tt.path, nil)); code != tt.code {
+				t.Errorf("got %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
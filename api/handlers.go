@@ -0,0 +1,376 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// reqLog returns the request-scoped logger set by Logged.
+func (a *Api) reqLog(r *http.Request) iotwifi.Logger {
+	return iotwifi.LoggerFromContext(r.Context(), a.log)
+}
+
+// wpa returns the WPA and AP client of the service for a request.
+func (a *Api) wpa(r *http.Request) *iotwifi.WpaCfg {
+	return a.svc.Wpa().WithContext(r.Context())
+}
+
+// payloadReturn writes an OK ApiReturn.
+func payloadReturn(w http.ResponseWriter, message string, payload interface{}) {
+	apiReturn := &ApiReturn{
+		Status:  "OK",
+		Message: message,
+		Payload: payload,
+	}
+	ret, _ := json.Marshal(apiReturn)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// marshallPost populates a struct with json in post body, on errors it
+// writes the response and the handler must return
+func (a *Api) marshallPost(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	log := a.reqLog(r)
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Error(err)
+		return err
+	}
+
+	defer r.Body.Close()
+
+	decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+
+	err = decoder.Decode(&v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// retError is the common error return from api
+func retError(w http.ResponseWriter, err error) {
+	apiReturn := &ApiReturn{
+		Status:  "FAIL",
+		Message: err.Error(),
+	}
+	ret, _ := json.Marshal(apiReturn)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// status returns the wpa_supplicant status
+func (a *Api) status(w http.ResponseWriter, r *http.Request) {
+	log := a.reqLog(r)
+
+	status, err := a.wpa(r).Status()
+	if err != nil {
+		log.Error(err.Error())
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "status", status)
+}
+
+// connect handles POSTs json in the form of iotwifi.WpaCredentials
+func (a *Api) connect(w http.ResponseWriter, r *http.Request) {
+	log := a.reqLog(r)
+
+	var creds iotwifi.WpaCredentials
+	if err := a.marshallPost(w, r, &creds); err != nil {
+		return
+	}
+
+	log.Info(map[string]interface{}{"ssid": creds.Ssid}, "Connect request")
+
+	connection, err := a.wpa(r).ConnectNetwork(creds)
+	if err != nil {
+		log.Error(err.Error())
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "Connection", connection)
+}
+
+// scan for wifi networks
+func (a *Api) scan(w http.ResponseWriter, r *http.Request) {
+	log := a.reqLog(r)
+	log.Info("Got Scan")
+
+	wpaNetworks, err := a.wpa(r).ScanNetworks()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "Networks", wpaNetworks)
+}
+
+// networks lists the networks saved in wpa_supplicant
+func (a *Api) networks(w http.ResponseWriter, r *http.Request) {
+	networks, err := a.wpa(r).SavedNetworks()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "Saved networks", networks)
+}
+
+// networkForget removes a saved network by id or ssid
+func (a *Api) networkForget(w http.ResponseWriter, r *http.Request) {
+	network := mux.Vars(r)["network"]
+
+	err := a.wpa(r).ForgetNetwork(network)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "Forgot "+network, nil)
+}
+
+// apClients lists clients of the AP
+func (a *Api) apClients(w http.ResponseWriter, r *http.Request) {
+	apClients, err := a.wpa(r).ApClients()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "AP clients", apClients)
+}
+
+// apDeauth deauthenticates a client of the AP
+func (a *Api) apDeauth(w http.ResponseWriter, r *http.Request) {
+	mac := mux.Vars(r)["mac"]
+
+	err := a.wpa(r).DeauthApClient(mac)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "Deauthenticated "+mac, nil)
+}
+
+// apStatus returns the hostapd status of the AP
+func (a *Api) apStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := a.wpa(r).ApStatus()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "AP status", status)
+}
+
+// apConfig changes the AP ssid and passphrase, PUT json in the form of
+// iotwifi.HostApdCfg
+func (a *Api) apConfig(w http.ResponseWriter, r *http.Request) {
+	var apCfg iotwifi.HostApdCfg
+	if err := a.marshallPost(w, r, &apCfg); err != nil {
+		return
+	}
+
+	err := a.wpa(r).SetApCredentials(apCfg.Ssid, apCfg.WpaPassphrase)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "AP reconfigured", nil)
+}
+
+// apEnable enables the AP
+func (a *Api) apEnable(w http.ResponseWriter, r *http.Request) {
+	err := a.wpa(r).EnableAp()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "AP enabled", nil)
+}
+
+// apDisable disables the AP
+func (a *Api) apDisable(w http.ResponseWriter, r *http.Request) {
+	err := a.wpa(r).DisableAp()
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "AP disabled", nil)
+}
+
+// config returns the effective configuration after overrides and
+// refreshes, without secrets
+func (a *Api) config(w http.ResponseWriter, r *http.Request) {
+	cfg := a.svc.Cfg()
+	payloadReturn(w, "effective configuration", cfg.Redacted())
+}
+
+// configReload reloads the configuration, applying only what changed
+func (a *Api) configReload(w http.ResponseWriter, r *http.Request) {
+	result, err := a.svc.Reload("api")
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "configuration reloaded", result)
+}
+
+// logLevel returns the current log levels, the global level is under
+// "level"
+func (a *Api) logLevel(w http.ResponseWriter, r *http.Request) {
+	levels := a.levels.Levels()
+	levels["level"] = levels[""]
+	delete(levels, "")
+
+	payloadReturn(w, "log levels", levels)
+}
+
+// logLevelSet sets the global log level, or the level of a source when
+// given in the form of {"level": "debug", "source": "dnsmasq"}
+func (a *Api) logLevelSet(w http.ResponseWriter, r *http.Request) {
+	setLevel := struct {
+		Level  string `json:"level"`
+		Source string `json:"source"`
+	}{}
+	if err := a.marshallPost(w, r, &setLevel); err != nil {
+		return
+	}
+
+	err := a.levels.SetLevel(setLevel.Source, setLevel.Level)
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	log := a.reqLog(r)
+	log.Info(map[string]interface{}{"level": setLevel.Level, "source": setLevel.Source}, "Log level changed")
+	a.logLevel(w, r)
+}
+
+// healthReturn writes health with 503 Service Unavailable when failing
+// so orchestration can act on the status code alone
+func healthReturn(w http.ResponseWriter, message string, health iotwifi.Health, payload interface{}) {
+	apiReturn := &ApiReturn{
+		Status:  health.Status,
+		Message: message,
+		Payload: payload,
+	}
+	ret, _ := json.Marshal(apiReturn)
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != iotwifi.HealthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(ret)
+}
+
+// healthz is liveness, the process is up and serving http
+func (a *Api) healthz(w http.ResponseWriter, r *http.Request) {
+	payloadReturn(w, "alive", nil)
+}
+
+// readyz is readiness, hostapd, wpa_supplicant and dnsmasq are
+// supervised and responsive
+func (a *Api) readyz(w http.ResponseWriter, r *http.Request) {
+	health := a.wpa(r).Health()
+	healthReturn(w, "ready", health, nil)
+}
+
+// health returns the detailed per-component health
+func (a *Api) health(w http.ResponseWriter, r *http.Request) {
+	health := a.wpa(r).Health()
+	healthReturn(w, "health", health, health)
+}
+
+// metrics in the prometheus text format
+func (a *Api) metrics(w http.ResponseWriter, r *http.Request) {
+	a.wpa(r).CollectMetrics()
+
+	w.Header().Set("Content-Type", iotwifi.MetricsContentType)
+	iotwifi.WriteMetrics(w)
+}
+
+// reset is a factory reset, wiping saved networks, certificates and
+// state then restarting the AP with its configured defaults
+func (a *Api) reset(w http.ResponseWriter, r *http.Request) {
+	err := a.svc.Reset("api")
+	if err != nil {
+		retError(w, err)
+		return
+	}
+
+	payloadReturn(w, "Factory reset, restarting.", nil)
+}
+
+// events streams events as server-sent events, ?type= filters by event
+// type with a trailing * matching a prefix, e.g. ?type=ap.*
+func (a *Api) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	topic := iotwifi.TopicEvent + "*"
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		topic = iotwifi.TopicEvent + eventType
+	}
+
+	sub := a.svc.Events().Subscribe(topic, 64, iotwifi.DeliverDropOldest)
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			w.Write([]byte(": keep-alive\n\n"))
+		case msg := <-sub.C:
+			event, ok := msg.Payload.(iotwifi.Event)
+			if !ok {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// kill publishes a kill command, the txwifi binary exits on it
+func (a *Api) kill(w http.ResponseWriter, r *http.Request) {
+	a.svc.Events().Publish(iotwifi.TopicCmd+"kill", iotwifi.CmdMessage{Id: "kill"})
+
+	payloadReturn(w, "Killing service.", nil)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/txn2/txwifi/api"
+	"github.com/txn2/txwifi/client"
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// errUsage is returned by commands given invalid arguments.
+var errUsage = errors.New("invalid arguments")
+
+// cliResult is the output of a command, payload is printed with -json,
+// otherwise the table with its header or the message.
+type cliResult struct {
+	payload interface{}
+	header  []string
+	rows    [][]string
+	message string
+}
+
+// messageResult is the result of a command without output of its own.
+func messageResult(message string) cliResult {
+	return cliResult{
+		payload: api.ApiReturn{Status: "OK", Message: message},
+		message: message,
+	}
+}
+
+// cliCommand is a command managing the running daemon through its API.
+// run parses its own flags from fs, -json is defined already.
+type cliCommand struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) (cliResult, error)
+}
+
+// cliCommands are the commands managing the running daemon.
+var cliCommands = map[string]cliCommand{
+	"status": {
+		usage: "status",
+		help:  "station, AP and connection state",
+		run:   cliStatus,
+	},
+	"scan": {
+		usage: "scan",
+		help:  "scan for networks",
+		run:   cliScan,
+	},
+	"connect": {
+		usage: "connect -ssid SSID [-psk PSK|-]",
+		help:  "connect the station to a network and save it",
+		run:   cliConnect,
+	},
+	"networks": {
+		usage: "networks list|forget ID|SSID",
+		help:  "list or remove saved networks",
+		run:   cliNetworks,
+	},
+	"ap": {
+		usage: "ap on|off|status",
+		help:  "enable, disable or show the AP",
+		run:   cliAp,
+	},
+}
+
+// usage prints the commands and global flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "  serve\trun the daemon, the default without a command\n")
+	fmt.Fprintf(w, "  validate-config [-device] [cfg ...]\tcheck configurations and exit\n")
+
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", cliCommands[name].usage, cliCommands[name].help)
+	}
+	w.Flush()
+
+	fmt.Fprintf(out, "\nCommands other than serve and validate-config talk to the daemon over\n"+
+		"the -socket, giving up after -timeout, and take -json to print JSON\n"+
+		"instead of a table. connect -psk - reads the passphrase from stdin.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// runCommand runs a command against the daemon listening on socket,
+// waiting at most timeout, and returns the exit status.
+func runCommand(args []string, socket string, timeout string) int {
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		return 2
+	}
+
+	wait, err := time.ParseDuration(timeout)
+	if err != nil || wait <= 0 {
+		fmt.Fprintf(os.Stderr, "IOTWIFI_TIMEOUT: %q is not a duration such as 30s\n", timeout)
+		return 2
+	}
+	if socket == socketOff {
+		fmt.Fprintf(os.Stderr, "txwifi %s: the API socket is off, set IOTWIFI_SOCKET or -socket to the daemon socket\n", args[0])
+		return 2
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	jsonOut := fs.Bool("json", false, "print JSON instead of a table")
+
+	c := client.New("http://txwifi", client.WithUnixSocket(socket))
+
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	result, err := cmd.run(ctx, c, fs, args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: %s %s\n", os.Args[0], cmd.usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "txwifi %s: %s\n", args[0], err.Error())
+		return 1
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result.payload)
+		return 0
+	}
+
+	printResult(os.Stdout, result)
+	return 0
+}
+
+// printResult writes the table or message of a result.
+func printResult(out io.Writer, result cliResult) {
+	if result.header == nil {
+		fmt.Fprintln(out, result.message)
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(result.header, "\t"))
+	for _, row := range result.rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+// parseArgs parses the flags of a command, before or after its
+// arguments, and checks the number of arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min int, max int) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(positional) < min || len(positional) > max {
+		return nil, errUsage
+	}
+
+	return positional, nil
+}
+
+// mapResult is a key and value table of m sorted by key.
+func mapResult(m map[string]string) cliResult {
+	result := cliResult{payload: m, header: []string{"KEY", "VALUE"}}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.rows = append(result.rows, []string{key, m[key]})
+	}
+
+	return result
+}
+
+func cliStatus(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) (cliResult, error) {
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return cliResult{}, err
+	}
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		return cliResult{}, err
+	}
+
+	return mapResult(status), nil
+}
+
+func cliScan(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) (cliResult, error) {
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return cliResult{}, err
+	}
+
+	networks, err := c.Scan(ctx)
+	if err != nil {
+		return cliResult{}, err
+	}
+
+	// strongest first
+	list := make([]iotwifi.WpaNetwork, 0, len(networks))
+	for _, network := range networks {
+		list = append(list, network)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		si, _ := strconv.Atoi(list[i].SignalLevel)
+		sj, _ := strconv.Atoi(list[j].SignalLevel)
+		if si != sj {
+			return si > sj
+		}
+		return list[i].Ssid < list[j].Ssid
+	})
+
+	result := cliResult{payload: list, header: []string{"SSID", "BSSID", "SIGNAL", "FREQUENCY", "FLAGS"}}
+	for _, network := range list {
+		result.rows = append(result.rows, []string{
+			network.Ssid, network.Bssid, network.SignalLevel, network.Frequency, network.Flags,
+		})
+	}
+
+	return result, nil
+}
+
+func cliConnect(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) (cliResult, error) {
+	ssid := fs.String("ssid", "", "network to connect to")
+	psk := fs.String("psk", "", "passphrase, none for open networks, - reads it from stdin")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return cliResult{}, err
+	}
+	if *ssid == "" {
+		return cliResult{}, errors.New("-ssid is required")
+	}
+
+	// keeps the passphrase out of the shell history and ps
+	if *psk == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return cliResult{}, fmt.Errorf("reading the passphrase from stdin: %s", err.Error())
+		}
+		*psk = strings.TrimRight(line, "\r\n")
+	}
+
+	connection, err := c.Connect(ctx, iotwifi.WpaCredentials{Ssid: *ssid, Psk: *psk})
+	if err != nil {
+		return cliResult{}, err
+	}
+	if connection.State == "FAIL" {
+		return cliResult{}, errors.New(connection.Message)
+	}
+
+	return cliResult{
+		payload: connection,
+		header:  []string{"SSID", "STATE"},
+		rows:    [][]string{{connection.Ssid, connection.State}},
+	}, nil
+}
+
+func cliNetworks(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) (cliResult, error) {
+	args, err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return cliResult{}, err
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		networks, err := c.Networks(ctx)
+		if err != nil {
+			return cliResult{}, err
+		}
+
+		result := cliResult{payload: networks, header: []string{"ID", "SSID", "PRIORITY", "FLAGS"}}
+		for _, network := range networks {
+			result.rows = append(result.rows, []string{
+				network.Id, network.Ssid, strconv.Itoa(network.Priority), network.Flags,
+			})
+		}
+		return result, nil
+
+	case args[0] == "forget" && len(args) == 2:
+		if err := c.ForgetNetwork(ctx, args[1]); err != nil {
+			return cliResult{}, err
+		}
+		return messageResult("Forgot " + args[1]), nil
+	}
+
+	return cliResult{}, errUsage
+}
+
+func cliAp(ctx context.Context, c *client.Client, fs *flag.FlagSet, args []string) (cliResult, error) {
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return cliResult{}, err
+	}
+
+	switch args[0] {
+	case "on":
+		if err := c.ApEnable(ctx); err != nil {
+			return cliResult{}, err
+		}
+		return messageResult("AP enabled"), nil
+
+	case "off":
+		if err := c.ApDisable(ctx); err != nil {
+			return cliResult{}, err
+		}
+		return messageResult("AP disabled"), nil
+
+	case "status":
+		status, err := c.ApStatus(ctx)
+		if err != nil {
+			return cliResult{}, err
+		}
+		return mapResult(status), nil
+	}
+
+	return cliResult{}, errUsage
+}
@@ -0,0 +1,258 @@
+// Package client is a Go client of the txwifi REST API, for fleet tools,
+// tests and applications talking to a txwifi daemon.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetries   = 3
+	defaultRetryWait = time.Second
+
+	// maxResponseSize limits the API responses read.
+	maxResponseSize = 4 << 20
+)
+
+// TransportError is a failure to reach the API or to read its response,
+// as opposed to an ApiError returned by the API.
+type TransportError struct {
+	Method string
+	Url    string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	// errors of http.Client name the request already
+	var urlErr *url.Error
+	if errors.As(e.Err, &urlErr) {
+		return "txwifi: " + e.Err.Error()
+	}
+
+	return fmt.Sprintf("txwifi: %s %s: %s", e.Method, e.Url, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// ApiError is a response with a status other than "OK", such as a
+// "FAIL" ApiReturn, or an HTTP error status.
+type ApiError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *ApiError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("txwifi: %d %s", e.StatusCode, e.Message)
+	}
+
+	return fmt.Sprintf("txwifi: %s: %s", e.Status, e.Message)
+}
+
+// apiReturn is the envelope of API responses, see api.ApiReturn.
+type apiReturn struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Client calls the txwifi REST API.
+type Client struct {
+	url       string
+	http      *http.Client
+	header    http.Header
+	retries   int
+	retryWait time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client of requests, http.DefaultClient by
+// default.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.http = httpClient
+	}
+}
+
+// WithUnixSocket sends requests over the unix domain socket at path of a
+// local daemon, the host of the url given to New is ignored.
+func WithUnixSocket(path string) Option {
+	return func(c *Client) {
+		dialer := &net.Dialer{}
+		c.http = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		}
+	}
+}
+
+// WithToken authenticates requests with a bearer token.
+func WithToken(token string) Option {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithBasicAuth authenticates requests with HTTP basic authentication.
+func WithBasicAuth(user string, password string) Option {
+	return func(c *Client) {
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(user, password)
+		c.header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+}
+
+// WithHeader adds a header to every request.
+func WithHeader(key string, value string) Option {
+	return func(c *Client) {
+		c.header.Set(key, value)
+	}
+}
+
+// WithRetry sets how often a request is retried after a connection
+// reset, 3 times by default, waiting wait and then longer between
+// attempts. Requests other than GET are only retried when the connection
+// was refused, as they may have been applied.
+func WithRetry(retries int, wait time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryWait = wait
+	}
+}
+
+// New returns a Client of the API at url, such as
+// http://192.168.27.1:8080 or http://localhost:8080/wifi.
+func New(url string, opts ...Option) *Client {
+	c := &Client{
+		url:       strings.TrimSuffix(url, "/"),
+		http:      http.DefaultClient,
+		header:    http.Header{},
+		retries:   defaultRetries,
+		retryWait: defaultRetryWait,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// retryable reports whether a request may be retried after err, which
+// happens when the AP restarts under a connection.
+func retryable(method string, err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	if method != "GET" && method != "HEAD" {
+		return false
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// send sends a request, retrying on connection resets.
+func (c *Client) send(ctx context.Context, method string, path string, in interface{}) (*http.Response, error) {
+	reqUrl := c.url + path
+
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, reqUrl, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for key, values := range c.header {
+			req.Header[key] = values
+		}
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := c.http.Do(req)
+		if err == nil {
+			return res, nil
+		}
+		if attempt >= c.retries || !retryable(method, err) {
+			return nil, &TransportError{Method: method, Url: reqUrl, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, &TransportError{Method: method, Url: reqUrl, Err: ctx.Err()}
+		case <-time.After(c.retryWait * time.Duration(attempt+1)):
+		}
+	}
+}
+
+// do calls an endpoint returning an ApiReturn and decodes its payload
+// into out. The payload of an error response is decoded as well.
+func (c *Client) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	res, err := c.send(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	fail := func(err error) error {
+		return &TransportError{Method: method, Url: c.url + path, Err: err}
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return fail(err)
+	}
+
+	ret := apiReturn{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		if res.StatusCode >= http.StatusBadRequest {
+			// plain errors such as 404 page not found
+			return &ApiError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(data))}
+		}
+		return fail(fmt.Errorf("invalid response: %s", err.Error()))
+	}
+
+	if out != nil && len(ret.Payload) > 0 && string(ret.Payload) != "null" {
+		if err := json.Unmarshal(ret.Payload, out); err != nil {
+			return fail(fmt.Errorf("invalid payload: %s", err.Error()))
+		}
+	}
+
+	if ret.Status != "OK" || res.StatusCode >= http.StatusBadRequest {
+		return &ApiError{StatusCode: res.StatusCode, Status: ret.Status, Message: ret.Message}
+	}
+
+	return nil
+}
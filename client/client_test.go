@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// refusingSocket returns the path of a unix socket nothing listens on,
+// connecting to it is refused.
+func refusingSocket(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "api.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	return path
+}
+
+func TestRetryConnectionRefused(t *testing.T) {
+	path := refusingSocket(t)
+
+	// the daemon comes up after the first attempts were refused
+	var requests int32
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"status":"OK","message":"reset","payload":null}`)
+	})}
+	defer server.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Remove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return
+		}
+		server.Serve(listener)
+	}()
+
+	c := New("http://txwifi", WithUnixSocket(path), WithRetry(10, 20*time.Millisecond))
+	if err := c.Reset(context.Background()); err != nil {
+		t.Fatalf("POST was not retried: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("%d requests reached the daemon, want 1", n)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	c := New("http://txwifi", WithUnixSocket(refusingSocket(t)), WithRetry(2, time.Millisecond))
+
+	err := c.Alive(context.Background())
+
+	var transportErr *TransportError
+	if !errors.As(err, &transportErr) {
+		t.Fatalf("got %T %v, want a *TransportError", err, err)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("got %v, want it to wrap ECONNREFUSED", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		transport  bool
+		apiStatus  string
+		statusCode int
+	}{
+		{name: "ok", status: 200, body: `{"status":"OK","message":"status","payload":{"wpa_state":"COMPLETED"}}`},
+		{name: "fail", status: 400, body: `{"status":"FAIL","message":"no such network","payload":null}`, apiStatus: "FAIL", statusCode: 400},
+		{name: "fail with 200", status: 200, body: `{"status":"FAIL","message":"scan failed","payload":null}`, apiStatus: "FAIL", statusCode: 200},
+		{name: "plain error", status: 404, body: "404 page not found\n", statusCode: 404},
+		{name: "invalid response", status: 200, body: "<html>", transport: true},
+		{name: "invalid payload", status: 200, body: `{"status":"OK","message":"status","payload":[1]}`, transport: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			status, err := New(server.URL).Status(context.Background())
+
+			var transportErr *TransportError
+			var apiErr *ApiError
+			switch {
+			case tt.transport:
+				if !errors.As(err, &transportErr) {
+					t.Errorf("got %T %v, want a *TransportError", err, err)
+				}
+			case tt.statusCode != 0:
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("got %T %v, want an *ApiError", err, err)
+				}
+				if apiErr.StatusCode != tt.statusCode || apiErr.Status != tt.apiStatus {
+					t.Errorf("got %+v, want status code %d and status %q", apiErr, tt.statusCode, tt.apiStatus)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status["wpa_state"] != "COMPLETED" {
+					t.Errorf("got status %v", status)
+				}
+			}
+		})
+	}
+}
+
+func TestEventsReconnect(t *testing.T) {
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") != "sta.*" {
+			http.Error(w, "missing type", http.StatusBadRequest)
+			return
+		}
+
+		// one event per connection, then the stream drops
+		n := atomic.AddInt32(&connections, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: sta.connected\ndata: {\"type\":\"sta.connected\",\"raw\":\"%d\"}\n\n", n)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events := []string{}
+	c := New(server.URL, WithRetry(0, 10*time.Millisecond))
+	err := c.Events(ctx, "sta.*", func(event iotwifi.Event) {
+		events = append(events, event.Raw)
+		if len(events) == 2 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0] != "1" || events[1] != "2" {
+		t.Errorf("got events %v, want one of each of 2 connections", events)
+	}
+}
+
+func TestEventsApiError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	err := New(server.URL).Events(context.Background(), "", func(iotwifi.Event) {})
+
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %v, want a 401 *ApiError", err)
+	}
+}
@@ -0,0 +1,241 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// Status returns the wpa_supplicant status with the AP, boot and
+// connection manager states, GET /status.
+func (c *Client) Status(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	err := c.do(ctx, "GET", "/status", nil, &status)
+
+	return status, err
+}
+
+// Scan scans for wifi networks, keyed by ssid, GET /scan.
+func (c *Client) Scan(ctx context.Context) (map[string]iotwifi.WpaNetwork, error) {
+	networks := map[string]iotwifi.WpaNetwork{}
+	err := c.do(ctx, "GET", "/scan", nil, &networks)
+
+	return networks, err
+}
+
+// Connect connects the station to a network, POST /connect. A failed
+// connection is returned with the state "FAIL" and a message.
+func (c *Client) Connect(ctx context.Context, creds iotwifi.WpaCredentials) (iotwifi.WpaConnection, error) {
+	connection := iotwifi.WpaConnection{}
+	err := c.do(ctx, "POST", "/connect", creds, &connection)
+
+	return connection, err
+}
+
+// Networks lists the networks saved in wpa_supplicant, GET /networks.
+func (c *Client) Networks(ctx context.Context) ([]iotwifi.SavedNetwork, error) {
+	networks := []iotwifi.SavedNetwork{}
+	err := c.do(ctx, "GET", "/networks", nil, &networks)
+
+	return networks, err
+}
+
+// ForgetNetwork removes the saved networks with the id or ssid network,
+// DELETE /networks/{network}.
+func (c *Client) ForgetNetwork(ctx context.Context, network string) error {
+	return c.do(ctx, "DELETE", "/networks/"+url.PathEscape(network), nil, nil)
+}
+
+// ApStatus returns the hostapd status of the AP, GET /ap/status.
+func (c *Client) ApStatus(ctx context.Context) (map[string]string, error) {
+	status := map[string]string{}
+	err := c.do(ctx, "GET", "/ap/status", nil, &status)
+
+	return status, err
+}
+
+// ApConfig changes the AP ssid and passphrase, an empty value is left
+// unchanged, PUT /ap/config.
+func (c *Client) ApConfig(ctx context.Context, ssid string, passphrase string) error {
+	apCfg := iotwifi.HostApdCfg{Ssid: ssid, WpaPassphrase: passphrase}
+
+	return c.do(ctx, "PUT", "/ap/config", apCfg, nil)
+}
+
+// ApEnable enables the AP, POST /ap/enable.
+func (c *Client) ApEnable(ctx context.Context) error {
+	return c.do(ctx, "POST", "/ap/enable", nil, nil)
+}
+
+// ApDisable disables the AP, POST /ap/disable.
+func (c *Client) ApDisable(ctx context.Context) error {
+	return c.do(ctx, "POST", "/ap/disable", nil, nil)
+}
+
+// ApClients lists the clients of the AP, GET /ap/clients.
+func (c *Client) ApClients(ctx context.Context) ([]iotwifi.ApClient, error) {
+	clients := []iotwifi.ApClient{}
+	err := c.do(ctx, "GET", "/ap/clients", nil, &clients)
+
+	return clients, err
+}
+
+// DeauthApClient disconnects a client of the AP, POST
+// /ap/clients/{mac}/deauth.
+func (c *Client) DeauthApClient(ctx context.Context, mac string) error {
+	return c.do(ctx, "POST", "/ap/clients/"+url.PathEscape(mac)+"/deauth", nil, nil)
+}
+
+// Config returns the effective configuration without secrets, GET
+// /config.
+func (c *Client) Config(ctx context.Context) (iotwifi.SetupCfg, error) {
+	cfg := iotwifi.SetupCfg{}
+	err := c.do(ctx, "GET", "/config", nil, &cfg)
+
+	return cfg, err
+}
+
+// ReloadConfig reloads the configuration, POST /config/reload.
+func (c *Client) ReloadConfig(ctx context.Context) (iotwifi.CfgReload, error) {
+	result := iotwifi.CfgReload{}
+	err := c.do(ctx, "POST", "/config/reload", nil, &result)
+
+	return result, err
+}
+
+// LogLevels returns the log levels, the global level under "level",
+// GET /log/level.
+func (c *Client) LogLevels(ctx context.Context) (map[string]string, error) {
+	levels := map[string]string{}
+	err := c.do(ctx, "GET", "/log/level", nil, &levels)
+
+	return levels, err
+}
+
+// SetLogLevel sets the log level of a source, or the global level when
+// source is empty, PUT /log/level.
+func (c *Client) SetLogLevel(ctx context.Context, source string, level string) error {
+	setLevel := map[string]string{"level": level, "source": source}
+
+	return c.do(ctx, "PUT", "/log/level", setLevel, nil)
+}
+
+// Alive checks the liveness of the daemon, GET /healthz.
+func (c *Client) Alive(ctx context.Context) error {
+	return c.do(ctx, "GET", "/healthz", nil, nil)
+}
+
+// Ready checks the readiness of the daemon, an *ApiError when it is not
+// ready, GET /readyz.
+func (c *Client) Ready(ctx context.Context) error {
+	return c.do(ctx, "GET", "/readyz", nil, nil)
+}
+
+// Health returns the health of each component, GET /health. When it is
+// not OK the health is returned with an *ApiError.
+func (c *Client) Health(ctx context.Context) (iotwifi.Health, error) {
+	health := iotwifi.Health{}
+	err := c.do(ctx, "GET", "/health", nil, &health)
+
+	return health, err
+}
+
+// Metrics returns the metrics in the Prometheus text format, GET
+// /metrics.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	res, err := c.send(ctx, "GET", "/metrics", nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", &TransportError{Method: "GET", Url: c.url + "/metrics", Err: err}
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", &ApiError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+
+	return string(data), nil
+}
+
+// Reset runs a factory reset, POST /reset.
+func (c *Client) Reset(ctx context.Context) error {
+	return c.do(ctx, "POST", "/reset", nil, nil)
+}
+
+// Kill makes the daemon exit, GET /kill.
+func (c *Client) Kill(ctx context.Context) error {
+	return c.do(ctx, "GET", "/kill", nil, nil)
+}
+
+// Events calls handler for each event of eventType, a trailing * matches
+// a prefix and "" matches all, GET /events. The stream is reconnected
+// when it drops, Events returns once ctx is done or the API fails.
+func (c *Client) Events(ctx context.Context, eventType string, handler func(iotwifi.Event)) error {
+	path := "/events"
+	if eventType != "" {
+		path += "?type=" + url.QueryEscape(eventType)
+	}
+
+	for {
+		res, err := c.send(ctx, "GET", path, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			data, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			return &ApiError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(data))}
+		}
+
+		err = readEvents(res, handler)
+		res.Body.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !retryable("GET", err) {
+			return &TransportError{Method: "GET", Url: c.url + path, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.retryWait):
+		}
+	}
+}
+
+// readEvents reads server-sent events until the stream ends.
+func readEvents(res *http.Response, handler func(iotwifi.Event)) error {
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxResponseSize)
+
+	data := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "" && data != "":
+			event := iotwifi.Event{}
+			if err := json.Unmarshal([]byte(data), &event); err == nil {
+				handler(event)
+			}
+			data = ""
+		}
+	}
+
+	return scanner.Err()
+}
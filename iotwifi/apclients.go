@@ -0,0 +1,225 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ApClient describes a client of the setup AP, merged from the hostapd
+// station list and the dnsmasq lease file.
+type ApClient struct {
+	Mac           string    `json:"mac"`
+	Associated    bool      `json:"associated"`
+	Signal        int       `json:"signal"`
+	ConnectedTime int       `json:"connected_time"`
+	InactiveMsec  int       `json:"inactive_msec"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+	Ip            string    `json:"ip"`
+	Hostname      string    `json:"hostname"`
+	VendorClass   string    `json:"vendor_class"`
+	Tags          []string  `json:"tags"`
+	LeaseExpires  time.Time `json:"lease_expires"`
+}
+
+// dhcpClientInfo is what dnsmasq logs about a client but does not keep
+// in its lease file.
+type dhcpClientInfo struct {
+	VendorClass string
+	Tags        []string
+}
+
+// dhcpObserver collects per-client DHCP details from dnsmasq log-dhcp
+// output. Details are logged per transaction id before the DHCPACK line
+// that ties the transaction to a MAC address.
+type dhcpObserver struct {
+	mu      sync.Mutex
+	pending map[string]dhcpClientInfo
+	clients map[string]dhcpClientInfo
+}
+
+var (
+	dhcpVendorR = regexp.MustCompile(`(\d+) vendor class: (.*)$`)
+	dhcpTagsR   = regexp.MustCompile(`(\d+) tags: (.*)$`)
+)
+
+// observe processes a dnsmasq event.
+func (d *dhcpObserver) observe(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	xid := event.Fields["xid"]
+
+	switch event.Type {
+	case EventDhcpVendorClass:
+		info := d.pending[xid]
+		info.VendorClass = event.Fields["vendor_class"]
+		d.pending[xid] = info
+	case EventDhcpTags:
+		info := d.pending[xid]
+		info.Tags = strings.Split(event.Fields["tags"], ",")
+		d.pending[xid] = info
+	case EventDhcpAck:
+		if info, ok := d.pending[xid]; ok {
+			d.clients[event.Mac] = info
+			delete(d.pending, xid)
+		}
+	}
+}
+
+// reset forgets all clients.
+func (d *dhcpObserver) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending = make(map[string]dhcpClientInfo)
+	d.clients = make(map[string]dhcpClientInfo)
+}
+
+// get returns the DHCP details for a MAC address.
+func (d *dhcpObserver) get(mac string) dhcpClientInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.clients[mac]
+}
+
+// ApClients returns the clients associated with the AP or holding a DHCP
+// lease from it.
+func (wpa *WpaCfg) ApClients() ([]ApClient, error) {
+	clients := make(map[string]*ApClient)
+
+	staOut, err := hostapdAllSta()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sta := range parseAllSta(staOut) {
+		sta := sta
+		clients[sta.Mac] = &sta
+	}
+
+	leases, err := readLeases(wpa.WpaCfg.Load().DnsmasqCfg.leaseFile())
+	if err != nil {
+		wpa.Log.Error("Could not read dnsmasq leases: %s", err.Error())
+	}
+
+	for _, lease := range leases {
+		client, ok := clients[lease.Mac]
+		if !ok {
+			client = &ApClient{Mac: lease.Mac}
+			clients[lease.Mac] = client
+		}
+		client.Ip = lease.Ip
+		client.Hostname = lease.Hostname
+		client.LeaseExpires = lease.LeaseExpires
+	}
+
+	apClients := make([]ApClient, 0, len(clients))
+	for mac, client := range clients {
+		info := wpa.st().dhcp.get(mac)
+		client.VendorClass = info.VendorClass
+		client.Tags = info.Tags
+		apClients = append(apClients, *client)
+	}
+
+	sort.Slice(apClients, func(i, j int) bool {
+		return apClients[i].Mac < apClients[j].Mac
+	})
+
+	return apClients, nil
+}
+
+// DeauthApClient disconnects a client from the AP.
+func (wpa *WpaCfg) DeauthApClient(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	wpa.Log.Info("Hostapd deauthenticate %s", hw.String())
+
+	return hostapdRequestOK("DEAUTHENTICATE " + hw.String())
+}
+
+// parseAllSta parses hostapd all_sta output. Each station starts with a
+// line holding its MAC address followed by key=value lines.
+func parseAllSta(data []byte) []ApClient {
+	stations := make([]ApClient, 0)
+
+	var sta *ApClient
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if hw, err := net.ParseMAC(line); err == nil {
+			stations = append(stations, ApClient{Mac: hw.String(), Associated: true})
+			sta = &stations[len(stations)-1]
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if sta == nil || len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "signal":
+			sta.Signal, _ = strconv.Atoi(kv[1])
+		case "connected_time":
+			sta.ConnectedTime, _ = strconv.Atoi(kv[1])
+		case "inactive_msec":
+			sta.InactiveMsec, _ = strconv.Atoi(kv[1])
+		case "rx_bytes":
+			sta.RxBytes, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "tx_bytes":
+			sta.TxBytes, _ = strconv.ParseInt(kv[1], 10, 64)
+		}
+	}
+
+	return stations
+}
+
+// readLeases parses a dnsmasq lease file. Lines have the form:
+// <expiry epoch> <mac> <ip> <hostname or *> <client id or *>
+func readLeases(leaseFile string) ([]ApClient, error) {
+	data, err := ioutil.ReadFile(leaseFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	leases := make([]ApClient, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		lease := ApClient{
+			Mac: strings.ToLower(fields[1]),
+			Ip:  fields[2],
+		}
+		if fields[3] != "*" {
+			lease.Hostname = fields[3]
+		}
+		if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil && expiry > 0 {
+			lease.LeaseExpires = time.Unix(expiry, 0)
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, nil
+}
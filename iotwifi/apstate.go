@@ -0,0 +1,195 @@
+package iotwifi
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// AP states reported by ApState.
+const (
+	ApStateStopped  = "stopped"
+	ApStateStarting = "starting"
+	ApStateEnabled  = "enabled"
+	ApStateDisabled = "disabled"
+	ApStateFailed   = "failed"
+)
+
+// Reasons hostapd failed to start, set on ApError.
+const (
+	ApFailInterfaceBusy  = "interface_busy"
+	ApFailInvalidChannel = "invalid_channel"
+	ApFailCountry        = "country_restricted"
+	ApFailNl80211        = "nl80211_not_found"
+	ApFailConfig         = "config_error"
+	ApFailTimeout        = "timeout"
+	ApFailDisabled       = "ap_disabled"
+	ApFailExited         = "exited"
+	ApFailStart          = "start_failed"
+)
+
+// apOutputLines is the number of hostapd output lines kept for ApError.
+const apOutputLines = 20
+
+// ApError describes a hostapd failure.
+type ApError struct {
+	Reason     string   `json:"reason"`
+	ExitStatus int      `json:"exit_status"`
+	Message    string   `json:"message"`
+	Output     []string `json:"output"`
+}
+
+// Error implements error.
+func (e *ApError) Error() string {
+	if e.ExitStatus != 0 {
+		return fmt.Sprintf("hostapd %s (exit status %d): %s", e.Reason, e.ExitStatus, e.Message)
+	}
+
+	return fmt.Sprintf("hostapd %s: %s", e.Reason, e.Message)
+}
+
+// hostapdFailures map hostapd output to a failure reason, first match wins.
+var hostapdFailures = []struct {
+	reason string
+	re     *regexp.Regexp
+}{
+	{ApFailNl80211, regexp.MustCompile(`(?i)nl80211.*(not found|driver initialization failed|could not configure driver mode)|nl80211 not found`)},
+	{ApFailInterfaceBusy, regexp.MustCompile(`(?i)device or resource busy|could not set interface .* flags|interface .* wasn't started`)},
+	{ApFailCountry, regexp.MustCompile(`(?i)(country|regulatory).*(not allowed|not permitted|restrict|invalid|failed)|no-ir|not allowed in current`)},
+	{ApFailInvalidChannel, regexp.MustCompile(`(?i)channel .*not (allowed|supported)|could not set channel|invalid channel|hw_mode .* not supported|configured channel .* not found`)},
+	{ApFailConfig, regexp.MustCompile(`(?i)^line \d+:|failed to set up interface|invalid configuration|unknown configuration item`)},
+}
+
+// classifyHostapd returns the failure reason matching hostapd output, or
+// fallback when nothing is recognised.
+func classifyHostapd(output []string, fallback string) (string, string) {
+	for _, failure := range hostapdFailures {
+		for _, line := range output {
+			if failure.re.MatchString(strings.TrimSpace(line)) {
+				return failure.reason, strings.TrimSpace(line)
+			}
+		}
+	}
+
+	if len(output) > 0 {
+		return fallback, strings.TrimSpace(output[len(output)-1])
+	}
+
+	return fallback, ""
+}
+
+// apStatus tracks the state of the hostapd process.
+type apStatus struct {
+	mu     sync.Mutex
+	state  string
+	err    *ApError
+	output []string
+	cmd    *exec.Cmd
+}
+
+// set changes the AP state.
+func (a *apStatus) set(state string, err *ApError) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.state = state
+	a.err = err
+
+	if state == ApStateStarting {
+		a.output = nil
+	}
+}
+
+// setCmd records the running hostapd process.
+func (a *apStatus) setCmd(cmd *exec.Cmd) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cmd = cmd
+}
+
+// stop kills a hostapd process started by StartAP. Its exit is not a
+// failure, as the process is no longer the recorded one.
+func (a *apStatus) stop() {
+	a.mu.Lock()
+	cmd := a.cmd
+	a.cmd = nil
+	a.state = ApStateStopped
+	a.err = nil
+	a.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// exited records cmd exiting as a failure, unless it was stopped or
+// replaced by another hostapd since, returning nil then.
+func (a *apStatus) exited(cmd *exec.Cmd, exitStatus int, message string) *ApError {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cmd != cmd {
+		return nil
+	}
+	a.cmd = nil
+
+	return a.failLocked(ApFailExited, exitStatus, message)
+}
+
+// line records hostapd output, keeping the last lines for ApError.
+func (a *apStatus) line(line string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.output = append(a.output, line)
+	if len(a.output) > apOutputLines {
+		a.output = a.output[len(a.output)-apOutputLines:]
+	}
+}
+
+// lines returns the recorded hostapd output.
+func (a *apStatus) lines() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]string{}, a.output...)
+}
+
+// fail records a failure classified from the recorded output.
+func (a *apStatus) fail(fallback string, exitStatus int, message string) *ApError {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.failLocked(fallback, exitStatus, message)
+}
+
+// failLocked is fail with a.mu held.
+func (a *apStatus) failLocked(fallback string, exitStatus int, message string) *ApError {
+	output := append([]string{}, a.output...)
+	reason, line := classifyHostapd(output, fallback)
+	if line != "" && reason != fallback {
+		message = line
+	}
+
+	apErr := &ApError{
+		Reason:     reason,
+		ExitStatus: exitStatus,
+		Message:    message,
+		Output:     output,
+	}
+	a.state = ApStateFailed
+	a.err = apErr
+
+	return apErr
+}
+
+// get returns the AP state and the last failure.
+func (a *apStatus) get() (string, *ApError) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.state, a.err
+}
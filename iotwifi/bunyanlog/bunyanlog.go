@@ -0,0 +1,30 @@
+// Package bunyanlog adapts go-bunyan loggers to iotwifi.Logger and
+// writes their JSON records as JSON or text to an output and a rotating
+// file.
+package bunyanlog
+
+import (
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+// logger adapts a bunyan.Logger.
+type logger struct {
+	log *bunyan.Logger
+}
+
+// New returns an iotwifi.Logger writing to a go-bunyan logger.
+func New(log bunyan.Logger) iotwifi.Logger {
+	return logger{log: &log}
+}
+
+func (l logger) Trace(args ...interface{}) { l.log.Trace(args...) }
+func (l logger) Debug(args ...interface{}) { l.log.Debug(args...) }
+func (l logger) Info(args ...interface{})  { l.log.Info(args...) }
+func (l logger) Warn(args ...interface{})  { l.log.Warn(args...) }
+func (l logger) Error(args ...interface{}) { l.log.Error(args...) }
+func (l logger) Fatal(args ...interface{}) { l.log.Fatal(args...) }
+
+func (l logger) Child(fields map[string]interface{}) iotwifi.Logger {
+	return New(l.log.Child(fields))
+}
@@ -0,0 +1,239 @@
+package bunyanlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"github.com/txn2/txwifi/iotwifi"
+)
+
+const (
+	defaultLogMaxSizeMb  = 10
+	defaultLogMaxBackups = 3
+)
+
+// levelNames maps numeric bunyan levels to their names.
+var levelNames = map[int]string{
+	10: bunyan.LogLevelTrace,
+	20: bunyan.LogLevelDebug,
+	30: bunyan.LogLevelInfo,
+	40: bunyan.LogLevelWarn,
+	50: bunyan.LogLevelError,
+	60: bunyan.LogLevelFatal,
+}
+
+// levelName returns the name of a numeric bunyan level.
+func levelName(level int) string {
+	if name, ok := levelNames[level]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", level)
+}
+
+// Sink receives bunyan JSON lines and writes them as JSON or text to its
+// output and an optional rotating file. Create the bunyan logger at
+// trace level with the sink as its stream and filter levels with
+// iotwifi.LogLevels.Logger, so they can be changed at runtime.
+type Sink struct {
+	format string
+	out    io.Writer
+	file   *rotatingFile
+}
+
+// NewSink creates a Sink from the format and file of cfg writing to out.
+func NewSink(cfg iotwifi.LogCfg, out io.Writer) (*Sink, error) {
+	sink := &Sink{
+		format: iotwifi.LogFormatJson,
+		out:    out,
+	}
+
+	switch cfg.Format {
+	case "", iotwifi.LogFormatJson:
+	case iotwifi.LogFormatText:
+		sink.format = iotwifi.LogFormatText
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+
+	if cfg.File.Path != "" {
+		file, err := newRotatingFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		sink.file = file
+	}
+
+	return sink, nil
+}
+
+// Write implements io.Writer for bunyan streams, p is one JSON record.
+func (s *Sink) Write(p []byte) (int, error) {
+	if s.format != iotwifi.LogFormatText {
+		return s.write(p)
+	}
+
+	record := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		// not a bunyan record, pass it through
+		return s.write(p)
+	}
+
+	if _, err := s.write(formatText(record)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// write writes to the output and the file.
+func (s *Sink) write(p []byte) (int, error) {
+	if s.file != nil {
+		if _, err := s.file.Write(p); err != nil {
+			fmt.Fprintf(os.Stderr, "log file: %s\n", err.Error())
+		}
+	}
+
+	if s.out == nil {
+		return len(p), nil
+	}
+
+	return s.out.Write(p)
+}
+
+// textSkipFields are bunyan fields not repeated as key=value in text.
+var textSkipFields = map[string]bool{
+	"v": true, "level": true, "name": true, "hostname": true,
+	"pid": true, "time": true, "msg": true,
+}
+
+// formatText renders a record as "time LEVEL msg key=value ...".
+func formatText(record map[string]interface{}) []byte {
+	var b bytes.Buffer
+
+	level := 0
+	if n, ok := record["level"].(json.Number); ok {
+		l, _ := n.Int64()
+		level = int(l)
+	}
+
+	fmt.Fprintf(&b, "%v %-5s %v", record["time"], strings.ToUpper(levelName(level)), record["msg"])
+
+	keys := make([]string, 0, len(record))
+	for key := range record {
+		if !textSkipFields[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := fmt.Sprintf("%v", record[key])
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	b.WriteString("\n")
+
+	return b.Bytes()
+}
+
+// rotatingFile is a log file rotated by size to path.1 ... path.N.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// newRotatingFile opens a rotating log file.
+func newRotatingFile(cfg iotwifi.LogFileCfg) (*rotatingFile, error) {
+	maxSizeMb := cfg.MaxSizeMb
+	if maxSizeMb <= 0 {
+		maxSizeMb = defaultLogMaxSizeMb
+	}
+	maxBackups := cfg.MaxBackups
+	if maxBackups <= 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+
+	r := &rotatingFile{
+		path:       cfg.Path,
+		maxSize:    int64(maxSizeMb) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return nil, err
+	}
+
+	return r, r.open()
+}
+
+// open opens the current file for appending.
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = fi.Size()
+
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, path to path.1 and reopens path.
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+
+	for i := r.maxBackups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i-1), fmt.Sprintf("%s.%d", r.path, i))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return r.open()
+}
+
+// Write appends to the file, rotating first if it would exceed maxSize.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, errors.New("log file closed")
+	}
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
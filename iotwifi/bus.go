@@ -0,0 +1,214 @@
+package iotwifi
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DeliveryPolicy decides what happens when a subscriber buffer is full.
+type DeliveryPolicy int
+
+const (
+	// DeliverBlock makes the publisher wait for buffer space. Publish
+	// delivers to one subscription after the other, so a full buffer
+	// stalls the producer and every subscription of the topic, such as
+	// the output readers of hostapd and wpa_supplicant. Use it only for
+	// subscribers that keep up, never on "*".
+	DeliverBlock DeliveryPolicy = iota
+	// DeliverDropNewest drops the message being published.
+	DeliverDropNewest
+	// DeliverDropOldest drops the oldest buffered message.
+	DeliverDropOldest
+)
+
+// BusMessage is a message published on an EventBus.
+type BusMessage struct {
+	Topic   string
+	Payload interface{}
+}
+
+// Bus topics. Command output is published as a CmdMessage on
+// TopicCmd+id, parsed events as an Event on TopicEvent+type.
+const (
+	TopicCmd   = "cmd."
+	TopicEvent = "event."
+)
+
+// Subscription receives messages for a topic on C until Unsubscribe.
+type Subscription struct {
+	C <-chan BusMessage
+
+	topic   string
+	policy  DeliveryPolicy
+	ch      chan BusMessage
+	done    chan struct{}
+	dropped uint64
+
+	mu     sync.RWMutex
+	closed bool
+	once   sync.Once
+	bus    *EventBus
+}
+
+// EventBus is a publish/subscribe bus with bounded per-subscriber
+// buffers. Topics are dot separated, a subscription topic matches a
+// topic exactly, "x.*" matches every topic starting with "x." and ""
+// or "*" match everything.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs []*Subscription
+}
+
+// NewEventBus creates an EventBus.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// topicMatch reports whether a subscription topic matches topic.
+func topicMatch(pattern string, topic string) bool {
+	switch {
+	case pattern == "" || pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, ".*"):
+		return strings.HasPrefix(topic, pattern[:len(pattern)-1])
+	}
+
+	return pattern == topic
+}
+
+// Subscribe returns a subscription to topic buffering up to buffer
+// messages.
+func (b *EventBus) Subscribe(topic string, buffer int, policy DeliveryPolicy) *Subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	ch := make(chan BusMessage, buffer)
+	s := &Subscription{
+		C:      ch,
+		topic:  topic,
+		policy: policy,
+		ch:     ch,
+		done:   make(chan struct{}),
+		bus:    b,
+	}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+
+	return s
+}
+
+// SubscribeFunc calls fn for each message of topic from its own
+// goroutine, so a slow handler only delays its own subscription.
+func (b *EventBus) SubscribeFunc(topic string, buffer int, policy DeliveryPolicy, fn func(BusMessage)) *Subscription {
+	s := b.Subscribe(topic, buffer, policy)
+
+	go func() {
+		for msg := range s.C {
+			fn(msg)
+		}
+	}()
+
+	return s
+}
+
+// Publish delivers payload to every subscription matching topic, in
+// turn, waiting on DeliverBlock subscriptions with a full buffer.
+func (b *EventBus) Publish(topic string, payload interface{}) {
+	msg := BusMessage{Topic: topic, Payload: payload}
+
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for _, s := range b.subs {
+		if topicMatch(s.topic, topic) {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		s.deliver(msg)
+	}
+}
+
+// PublishEvent publishes an event on TopicEvent+event.Type.
+func (b *EventBus) PublishEvent(event Event) {
+	b.Publish(TopicEvent+event.Type, event)
+}
+
+// remove drops a subscription from the bus.
+func (b *EventBus) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// deliver sends msg according to the delivery policy.
+func (s *Subscription) deliver(msg BusMessage) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	switch s.policy {
+	case DeliverBlock:
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+		}
+		return
+	case DeliverDropOldest:
+		select {
+		case s.ch <- msg:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+			s.drop()
+		default:
+		}
+	}
+
+	select {
+	case s.ch <- msg:
+	default:
+		s.drop()
+	}
+}
+
+// drop counts a dropped message.
+func (s *Subscription) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+	metricBusDropped.Inc(s.topic)
+}
+
+// Dropped returns the number of messages dropped for a full buffer.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe removes the subscription from its bus and closes C. It
+// releases publishers blocked on a full buffer.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.bus.remove(s)
+		close(s.done)
+
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
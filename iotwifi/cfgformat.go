@@ -0,0 +1,433 @@
+package iotwifi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration formats.
+const (
+	CfgFormatJson = "json"
+	CfgFormatYaml = "yaml"
+	CfgFormatToml = "toml"
+)
+
+// CfgEnvPrefix prefixes the environment variables overriding settings.
+const CfgEnvPrefix = "IOTWIFI_"
+
+// redacted replaces secrets in the effective configuration.
+const redacted = "REDACTED"
+
+// cfgFormat detects the format of a configuration from the extension of
+// its location or the Content-Type of a url, falling back to JSON.
+func cfgFormat(location string, contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch {
+		case strings.HasSuffix(mediaType, "yaml"):
+			return CfgFormatYaml
+		case strings.HasSuffix(mediaType, "toml"):
+			return CfgFormatToml
+		case strings.HasSuffix(mediaType, "json"):
+			return CfgFormatJson
+		}
+	}
+
+	// drop any url query
+	if i := strings.IndexAny(location, "?#"); i >= 0 {
+		location = location[:i]
+	}
+
+	switch strings.ToLower(path.Ext(location)) {
+	case ".yaml", ".yml":
+		return CfgFormatYaml
+	case ".toml":
+		return CfgFormatToml
+	}
+
+	return CfgFormatJson
+}
+
+// decodeCfg decodes a configuration in format into v, unknown fields
+// and duplicate keys are errors.
+func decodeCfg(data []byte, format string, v *SetupCfg) error {
+	var doc interface{}
+
+	switch format {
+	case CfgFormatYaml:
+		if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+			return err
+		}
+	case CfgFormatToml:
+		table := map[string]interface{}{}
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return err
+		}
+		doc = table
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	}
+
+	doc, err := cfgDoc(doc, "")
+	if err != nil {
+		return err
+	}
+
+	return assignCfg(reflect.ValueOf(v).Elem(), doc, "")
+}
+
+// cfgDoc converts a decoded YAML or TOML document to the string keyed
+// maps, slices and scalars assignCfg expects.
+func cfgDoc(data interface{}, at string) (interface{}, error) {
+	switch d := data.(type) {
+	case nil, string, bool, int, int64, uint64, float64:
+		return d, nil
+
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(d))
+		for key, item := range d {
+			value, err := cfgDoc(item, joinPath(at, key))
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(d))
+		for k, item := range d {
+			key, ok := k.(string)
+			if !ok {
+				if at == "" {
+					return nil, fmt.Errorf("key %v is not a string, quote it", k)
+				}
+				return nil, fmt.Errorf("%s: key %v is not a string, quote it", at, k)
+			}
+			value, err := cfgDoc(item, joinPath(at, key))
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+
+	case []interface{}:
+		items := make([]interface{}, len(d))
+		for i, item := range d {
+			value, err := cfgDoc(item, fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return items, nil
+
+	case []map[string]interface{}:
+		items := make([]interface{}, len(d))
+		for i, item := range d {
+			value, err := cfgDoc(item, fmt.Sprintf("%s[%d]", at, i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return items, nil
+	}
+
+	if at == "" {
+		return nil, fmt.Errorf("unsupported value %v", data)
+	}
+	return nil, fmt.Errorf("%s: unsupported value %v", at, data)
+}
+
+// jsonName returns the json name of a struct field, or "".
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+
+	return name
+}
+
+// joinPath joins a configuration path with a field name.
+func joinPath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "." + name
+}
+
+// assignCfg assigns a parsed YAML or TOML value to v, converting the
+// string scalars to the type of v by the json names of its fields.
+func assignCfg(v reflect.Value, data interface{}, at string) error {
+	if data == nil {
+		return nil
+	}
+
+	fail := func(format string, a ...interface{}) error {
+		if at == "" {
+			return fmt.Errorf(format, a...)
+		}
+		return fmt.Errorf("%s: %s", at, fmt.Sprintf(format, a...))
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		m, ok := data.(map[string]interface{})
+		if !ok {
+			return fail("expected a table of settings")
+		}
+
+		fields := map[string]int{}
+		for i := 0; i < v.NumField(); i++ {
+			if name := jsonName(v.Type().Field(i)); name != "" {
+				fields[name] = i
+			}
+		}
+
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			i, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("unknown field %q", joinPath(at, key))
+			}
+			if err := assignCfg(v.Field(i), m[key], joinPath(at, key)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		items, ok := data.([]interface{})
+		if !ok {
+			return fail("expected a list")
+		}
+
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := assignCfg(slice.Index(i), item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+
+	case reflect.Map:
+		m, ok := data.(map[string]interface{})
+		if !ok {
+			return fail("expected a table")
+		}
+
+		out := reflect.MakeMap(v.Type())
+		for key, item := range m {
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := assignCfg(value, item, joinPath(at, key)); err != nil {
+				return err
+			}
+			out.SetMapIndex(reflect.ValueOf(key), value)
+		}
+		v.Set(out)
+		return nil
+	}
+
+	switch d := data.(type) {
+	case string:
+		return assignScalar(v, d, at)
+
+	case bool, int, int64, uint64, float64:
+		// YAML 1.1 reads unquoted yes, no, on and off as booleans and
+		// unquoted numbers as numbers, which do not render back as
+		// written, so string settings must be quoted
+		if v.Kind() == reflect.String {
+			return fail("%v is not a string, quote it", d)
+		}
+		return assignScalar(v, fmt.Sprint(d), at)
+	}
+
+	return fail("expected a value")
+}
+
+// assignScalar sets a string, int or bool setting from text.
+func assignScalar(v reflect.Value, s string, at string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", at, s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", at, s)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("%s: unsupported setting type %s", at, v.Type())
+	}
+
+	return nil
+}
+
+// cfgPaths appends the paths of the settings of struct type t.
+func cfgPaths(t reflect.Type, prefix string, paths []string) []string {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonName(field)
+		if name == "" {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			paths = cfgPaths(field.Type, joinPath(prefix, name), paths)
+			continue
+		}
+		paths = append(paths, joinPath(prefix, name))
+	}
+
+	return paths
+}
+
+// CfgPaths returns the path of every setting, such as host_apd_cfg.ssid.
+func CfgPaths() []string {
+	return cfgPaths(reflect.TypeOf(SetupCfg{}), "", nil)
+}
+
+// CfgEnvName returns the environment variable overriding the setting at
+// path, host_apd_cfg.ssid is IOTWIFI_HOST_APD_CFG_SSID.
+func CfgEnvName(path string) string {
+	return CfgEnvPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// cfgField returns the setting of c at path.
+func (c *SetupCfg) cfgField(path string) (reflect.Value, error) {
+	v := reflect.ValueOf(c).Elem()
+
+	for _, name := range strings.Split(path, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("unknown setting %q", path)
+		}
+
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if jsonName(v.Type().Field(i)) == name {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, fmt.Errorf("unknown setting %q", path)
+		}
+	}
+
+	if v.Kind() == reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("%q is a section, not a setting", path)
+	}
+
+	return v, nil
+}
+
+// Set overrides the setting at path from text. Lists are comma
+// separated, maps are comma separated key=value pairs, and both may be
+// given as JSON instead.
+func (c *SetupCfg) Set(path string, text string) error {
+	v, err := c.cfgField(path)
+	if err != nil {
+		return err
+	}
+
+	trimmed := strings.TrimSpace(text)
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+			value := reflect.New(v.Type())
+			if err := json.Unmarshal([]byte(trimmed), value.Interface()); err != nil {
+				return fmt.Errorf("%s: %s", path, err.Error())
+			}
+			v.Set(value.Elem())
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return fmt.Errorf("%s: expected a JSON list", path)
+		}
+		items := []interface{}{}
+		if trimmed != "" {
+			for _, item := range strings.Split(text, ",") {
+				items = append(items, strings.TrimSpace(item))
+			}
+		}
+		return assignCfg(v, items, path)
+
+	case reflect.Map:
+		m := map[string]interface{}{}
+		if trimmed != "" {
+			for _, pair := range strings.Split(text, ",") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					return fmt.Errorf("%s: %q is not key=value", path, pair)
+				}
+				m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+		return assignCfg(v, m, path)
+	}
+
+	return assignScalar(v, text, path)
+}
+
+// applyEnv overrides settings from their environment variables, see
+// CfgEnvName.
+func (c *SetupCfg) applyEnv() error {
+	for _, path := range CfgPaths() {
+		value, ok := os.LookupEnv(CfgEnvName(path))
+		if !ok {
+			continue
+		}
+		if err := c.Set(path, value); err != nil {
+			return fmt.Errorf("%s: %s", CfgEnvName(path), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the AP passphrase
+// and passphrase secret replaced.
+func (c SetupCfg) Redacted() SetupCfg {
+	if c.HostApdCfg.WpaPassphrase != "" {
+		c.HostApdCfg.WpaPassphrase = redacted
+	}
+	if c.HostApdCfg.PassphraseSecret != "" {
+		c.HostApdCfg.PassphraseSecret = redacted
+	}
+
+	return c
+}
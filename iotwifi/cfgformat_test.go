@@ -0,0 +1,179 @@
+package iotwifi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCfg(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   SetupCfg
+		err    string
+	}{
+		{
+			name:   "yaml quoting and comments",
+			format: CfgFormatYaml,
+			data: `# access point
+host_apd_cfg:
+  ssid: "iot \"wifi\" # 1" # trailing comment
+  wpa_passphrase: 'it''s # secret'
+  channel: "6"
+`,
+			want: SetupCfg{HostApdCfg: HostApdCfg{Ssid: `iot "wifi" # 1`, WpaPassphrase: "it's # secret", Channel: "6"}},
+		},
+		{
+			name:   "yaml nesting",
+			format: CfgFormatYaml,
+			data: `dnsmasq_cfg:
+  forward: true
+  servers: [8.8.8.8, 1.1.1.1]
+  dhcp_hosts:
+    - mac: "b8:27:eb:00:00:01"
+      ip: 192.168.27.10
+log_cfg:
+  sources: {dnsmasq: warn}
+  file:
+    max_size_mb: 10
+`,
+			want: SetupCfg{
+				DnsmasqCfg: DnsmasqCfg{
+					Forward:   true,
+					Servers:   []string{"8.8.8.8", "1.1.1.1"},
+					DhcpHosts: []DnsmasqHost{{Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.10"}},
+				},
+				LogCfg: LogCfg{Sources: map[string]string{"dnsmasq": "warn"}, File: LogFileCfg{MaxSizeMb: 10}},
+			},
+		},
+		{
+			name:   "yaml duplicate key",
+			format: CfgFormatYaml,
+			data:   "host_apd_cfg:\n  ssid: a\n  ssid: b\n",
+			err:    "already set",
+		},
+		{
+			name:   "yaml unknown field",
+			format: CfgFormatYaml,
+			data:   "host_apd_cfg:\n  sid: a\n",
+			err:    `unknown field "host_apd_cfg.sid"`,
+		},
+		{
+			name:   "yaml bad number",
+			format: CfgFormatYaml,
+			data:   "host_apd_cfg:\n  start_retries: 1.5\n",
+			err:    "not a number",
+		},
+		{
+			name:   "yaml boolean string",
+			format: CfgFormatYaml,
+			data:   "host_apd_cfg:\n  ssid: yes\n",
+			err:    "host_apd_cfg.ssid: true is not a string, quote it",
+		},
+		{
+			name:   "yaml number string",
+			format: CfgFormatYaml,
+			data:   "host_apd_cfg:\n  wpa_passphrase: 123456789012345678901\n",
+			err:    "host_apd_cfg.wpa_passphrase: 1.2345678901234568e+20 is not a string, quote it",
+		},
+		{
+			name:   "yaml octal string",
+			format: CfgFormatYaml,
+			data:   "reset_cfg:\n  gpio_pin: 017\n",
+			err:    "reset_cfg.gpio_pin: 15 is not a string, quote it",
+		},
+		{
+			name:   "yaml boolean key",
+			format: CfgFormatYaml,
+			data:   "log_cfg:\n  sources: {on: warn}\n",
+			err:    "log_cfg.sources: key true is not a string, quote it",
+		},
+		{
+			name:   "yaml quoted strings",
+			format: CfgFormatYaml,
+			data:   "host_apd_cfg:\n  ssid: \"yes\"\n  wpa_passphrase: '12345678901234567890'\n",
+			want:   SetupCfg{HostApdCfg: HostApdCfg{Ssid: "yes", WpaPassphrase: "12345678901234567890"}},
+		},
+		{
+			name:   "yaml typed scalars",
+			format: CfgFormatYaml,
+			data:   "dnsmasq_cfg:\n  forward: yes\nlog_cfg:\n  file:\n    max_size_mb: 10\n",
+			want:   SetupCfg{DnsmasqCfg: DnsmasqCfg{Forward: true}, LogCfg: LogCfg{File: LogFileCfg{MaxSizeMb: 10}}},
+		},
+		{
+			name:   "toml quoting and comments",
+			format: CfgFormatToml,
+			data: `# access point
+[host_apd_cfg]
+ssid = "iot \"wifi\" # 1" # trailing comment
+wpa_passphrase = 'C:\pass # word'
+channel = "6"
+`,
+			want: SetupCfg{HostApdCfg: HostApdCfg{Ssid: `iot "wifi" # 1`, WpaPassphrase: `C:\pass # word`, Channel: "6"}},
+		},
+		{
+			name:   "toml nesting",
+			format: CfgFormatToml,
+			data: `[dnsmasq_cfg]
+forward = true
+servers = ["8.8.8.8", "1.1.1.1"]
+
+[[dnsmasq_cfg.dhcp_hosts]]
+mac = "b8:27:eb:00:00:01"
+ip = "192.168.27.10"
+
+[log_cfg]
+sources = { dnsmasq = "warn" }
+file.max_size_mb = 10
+`,
+			want: SetupCfg{
+				DnsmasqCfg: DnsmasqCfg{
+					Forward:   true,
+					Servers:   []string{"8.8.8.8", "1.1.1.1"},
+					DhcpHosts: []DnsmasqHost{{Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.10"}},
+				},
+				LogCfg: LogCfg{Sources: map[string]string{"dnsmasq": "warn"}, File: LogFileCfg{MaxSizeMb: 10}},
+			},
+		},
+		{
+			name:   "toml duplicate table",
+			format: CfgFormatToml,
+			data:   "[host_apd_cfg]\nssid = \"a\"\n[host_apd_cfg]\nchannel = \"6\"\n",
+			err:    "already been defined",
+		},
+		{
+			name:   "toml number string",
+			format: CfgFormatToml,
+			data:   "[host_apd_cfg]\nchannel = 6\n",
+			err:    "host_apd_cfg.channel: 6 is not a string, quote it",
+		},
+		{
+			name:   "toml unknown field",
+			format: CfgFormatToml,
+			data:   "[host_apd_cfg]\nsid = \"a\"\n",
+			err:    `unknown field "host_apd_cfg.sid"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SetupCfg{}
+			err := decodeCfg([]byte(tt.data), tt.format, &got)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,23 @@
 package iotwifi
 
 import (
+	"net"
 	"os/exec"
-
-	"github.com/bhoriuchi/go-bunyan/bunyan"
+	"sync"
 )
 
 // Command for device network commands.
 type Command struct {
-	Log      bunyan.Logger
+	Log      Logger
 	Runner   CmdRunner
-	SetupCfg *SetupCfg
+	SetupCfg *SharedCfg
+
+	// dns records whether the running dnsmasq forwards DNS
+	dns struct {
+		sync.Mutex
+		started  bool
+		upstream bool
+	}
 }
 
 // RemoveApInterface removes the AP interface.
@@ -22,7 +29,14 @@ func (c *Command) RemoveApInterface() {
 
 // ConfigureApInterface configured the AP interface.
 func (c *Command) ConfigureApInterface() {
-	cmd := exec.Command("ifconfig", "uap0", c.SetupCfg.HostApdCfg.Ip)
+	hostApdCfg := c.SetupCfg.Load().HostApdCfg
+
+	args := []string{"uap0", hostApdCfg.Ip}
+	if subnet, err := hostApdCfg.subnet(); err == nil {
+		args = append(args, "netmask", net.IP(subnet.Mask).String())
+	}
+
+	cmd := exec.Command("ifconfig", args...)
 	cmd.Start()
 	cmd.Wait()
 }
@@ -44,38 +58,70 @@ func (c *Command) AddApInterface() {
 // CheckInterface checks the AP interface.
 func (c *Command) CheckApInterface() {
 	cmd := exec.Command("ifconfig", "uap0")
-	go c.Runner.ProcessCmd("ifconfig_uap0", cmd)
+	if err := c.Runner.ProcessCmd("ifconfig_uap0", cmd); err != nil {
+		c.Log.Error("Could not check uap0: %s", err.Error())
+	}
 }
 
-// StartWpaSupplicant starts wpa_supplicant.
-func (c *Command) StartWpaSupplicant() {
+// StartWpaSupplicant starts wpa_supplicant, stopping one started
+// earlier.
+func (c *Command) StartWpaSupplicant() error {
+	c.Runner.stop("wpa_supplicant")
 
 	args := []string{
 		"-d",
 		"-Dnl80211",
 		"-iwlan0",
-		"-c" + c.SetupCfg.WpaSupplicantCfg.CfgFile,
+		"-c" + c.SetupCfg.Load().WpaSupplicantCfg.CfgFile,
 	}
 
 	cmd := exec.Command("wpa_supplicant", args...)
-	go c.Runner.ProcessCmd("wpa_supplicant", cmd)
+
+	return c.Runner.ProcessCmd("wpa_supplicant", cmd)
 }
 
-// StartDnsmasq starts dnsmasq.
-func (c *Command) StartDnsmasq() {
+// StartDnsmasq validates and renders the dnsmasq configuration and
+// starts dnsmasq with it, stopping one started earlier. With forward set
+// DNS is forwarded only if the station is connected at the time.
+func (c *Command) StartDnsmasq() error {
+	c.Runner.stop("dnsmasq")
+
+	setupCfg := c.SetupCfg.Load()
+	dnsmasqCfg := &setupCfg.DnsmasqCfg
+
+	err := dnsmasqCfg.Validate(&setupCfg.HostApdCfg)
+	if err != nil {
+		return err
+	}
+
+	upstream := dnsmasqCfg.Forward && stationConnected()
+	confFile, err := dnsmasqCfg.writeConf(upstream)
+	if err != nil {
+		return err
+	}
+
 	// hostapd is enabled, fire up dnsmasq
 	args := []string{
-		"--no-hosts", // Don't read the hostnames in /etc/hosts.
 		"--keep-in-foreground",
-		"--log-queries",
-		"--no-resolv",
-		"--address=" + c.SetupCfg.DnsmasqCfg.Address,
-		"--dhcp-range=" + c.SetupCfg.DnsmasqCfg.DhcpRange,
-		"--dhcp-vendorclass=" + c.SetupCfg.DnsmasqCfg.VendorClass,
-		"--dhcp-authoritative",
-		"--log-facility=-",
+		"--conf-file=" + confFile,
 	}
 
 	cmd := exec.Command("dnsmasq", args...)
-	go c.Runner.ProcessCmd("dnsmasq", cmd)
+	err = c.Runner.ProcessCmd("dnsmasq", cmd)
+
+	c.dns.Lock()
+	c.dns.started = err == nil
+	c.dns.upstream = upstream
+	c.dns.Unlock()
+
+	return err
+}
+
+// dnsmasqForwarding reports whether dnsmasq was started, and whether it
+// forwards DNS upstream.
+func (c *Command) dnsmasqForwarding() (bool, bool) {
+	c.dns.Lock()
+	defer c.dns.Unlock()
+
+	return c.dns.started, c.dns.upstream
 }
@@ -0,0 +1,435 @@
+package iotwifi
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection manager states.
+const (
+	ConnStateIdle         = "idle"
+	ConnStateConnected    = "connected"
+	ConnStateDisconnected = "disconnected"
+	ConnStateConnecting   = "connecting"
+	ConnStateRecovering   = "recovering"
+)
+
+// Recovery actions run when the station has no connectivity for
+// ConnMgrCfg.RecoveryAfter.
+const (
+	RecoverRestartSupplicant = "restart_supplicant"
+	RecoverEnableAp          = "enable_ap"
+)
+
+// EventConnState is published when the connection manager changes state.
+const EventConnState = "conn.state"
+
+const (
+	defaultConnCheckInterval  = 10 * time.Second
+	defaultConnBackoffMin     = 5 * time.Second
+	defaultConnBackoffMax     = 5 * time.Minute
+	defaultConnAttemptTimeout = 30 * time.Second
+	defaultConnRecoveryAfter  = 10 * time.Minute
+)
+
+// SavedNetwork is a network saved in wpa_supplicant.
+type SavedNetwork struct {
+	Id          string    `json:"id"`
+	Ssid        string    `json:"ssid"`
+	Flags       string    `json:"flags"`
+	Priority    int       `json:"priority"`
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// ConnStatus is the state of the connection manager.
+type ConnStatus struct {
+	State             string    `json:"state"`
+	Ssid              string    `json:"ssid"`
+	DisconnectedSince time.Time `json:"disconnected_since"`
+	NextAttempt       time.Time `json:"next_attempt"`
+	Attempts          int       `json:"attempts"`
+	Recoveries        int       `json:"recoveries"`
+}
+
+// connStatus holds the ConnStatus shared with the API, state changes
+// are published on events.
+type connStatus struct {
+	mu     sync.Mutex
+	status ConnStatus
+	events *EventBus
+}
+
+// get returns the status.
+func (c *connStatus) get() ConnStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// update changes the status and publishes state changes.
+func (c *connStatus) update(fn func(s *ConnStatus)) {
+	c.mu.Lock()
+	before := c.status.State
+	fn(&c.status)
+	status := c.status
+	c.mu.Unlock()
+
+	if status.State != before {
+		c.events.PublishEvent(Event{
+			Type:   EventConnState,
+			Source: "txwifi",
+			Time:   time.Now(),
+			Fields: map[string]string{"state": status.State, "previous": before, "ssid": status.Ssid},
+		})
+	}
+}
+
+// connDuration parses a ConnMgrCfg duration, fallback if empty or invalid.
+func connDuration(setting string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(setting); err == nil && d > 0 {
+		return d
+	}
+
+	return fallback
+}
+
+// ConnManager watches the station link and reconnects across saved
+// networks, see ConnMgrCfg. It reports its state on the Service of Wpa.
+type ConnManager struct {
+	Log     Logger
+	Wpa     *WpaCfg
+	Recover map[string]func() error
+
+	checkInterval  time.Duration
+	backoffMin     time.Duration
+	backoffMax     time.Duration
+	attemptTimeout time.Duration
+	recoveryAfter  time.Duration
+	actions        []string
+
+	backoff     time.Duration
+	lastSuccess map[string]time.Time
+	recoveredAt time.Time
+
+	// tried holds the ids of the networks attempted in this round
+	tried map[string]bool
+}
+
+// NewConnManager creates a ConnManager, recover holds the functions run
+// for the configured recovery actions.
+func NewConnManager(log Logger, wpa *WpaCfg, cfg ConnMgrCfg, recover map[string]func() error) *ConnManager {
+	actions := cfg.RecoveryActions
+	if actions == nil {
+		actions = []string{RecoverRestartSupplicant, RecoverEnableAp}
+	}
+
+	return &ConnManager{
+		Log:            orNop(log),
+		Wpa:            wpa,
+		Recover:        recover,
+		checkInterval:  connDuration(cfg.CheckInterval, defaultConnCheckInterval),
+		backoffMin:     connDuration(cfg.BackoffMin, defaultConnBackoffMin),
+		backoffMax:     connDuration(cfg.BackoffMax, defaultConnBackoffMax),
+		attemptTimeout: connDuration(cfg.AttemptTimeout, defaultConnAttemptTimeout),
+		recoveryAfter:  connDuration(cfg.RecoveryAfter, defaultConnRecoveryAfter),
+		actions:        actions,
+		tried:          make(map[string]bool),
+		lastSuccess:    make(map[string]time.Time),
+	}
+}
+
+// Run watches station events and the link state until stop is closed.
+func (m *ConnManager) Run(stop <-chan struct{}) {
+	sub := m.Wpa.st().events.Subscribe(TopicEvent+"sta.*", 32, DeliverDropOldest)
+	defer sub.Unsubscribe()
+
+	resets := m.Wpa.st().events.Subscribe(TopicEvent+EventResetStarted, 1, DeliverDropNewest)
+	defer resets.Unsubscribe()
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	m.check()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case msg := <-sub.C:
+			if event, ok := msg.Payload.(Event); ok {
+				m.observe(event)
+			}
+		case <-resets.C:
+			m.backoff = 0
+			m.tried = make(map[string]bool)
+			m.recoveredAt = time.Time{}
+			m.lastSuccess = make(map[string]time.Time)
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// observe reacts to wpa_supplicant events between checks.
+func (m *ConnManager) observe(event Event) {
+	switch event.Type {
+	case EventStaConnected:
+		m.check()
+	case EventStaDisconnected, "sta.ssid_temp_disabled", "sta.network_not_found":
+		m.Log.Info(map[string]interface{}{"event": event.Type}, "Station link lost")
+		m.check()
+	}
+}
+
+// check updates the state from wpa_supplicant and reconnects or recovers
+// when due.
+func (m *ConnManager) check() {
+	status, err := m.wpaStatus()
+	if err != nil {
+		m.Log.Error("Connection manager could not get status: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+
+	if status["wpa_state"] == "COMPLETED" {
+		ssid := status["ssid"]
+		m.lastSuccess[ssid] = now
+		m.backoff = 0
+		m.tried = make(map[string]bool)
+		m.recoveredAt = time.Time{}
+		m.Wpa.st().conn.update(func(s *ConnStatus) {
+			s.State = ConnStateConnected
+			s.Ssid = ssid
+			s.DisconnectedSince = time.Time{}
+			s.NextAttempt = time.Time{}
+			s.Attempts = 0
+		})
+		return
+	}
+
+	networks, err := m.savedNetworks()
+	if err != nil {
+		m.Log.Error("Connection manager could not list networks: %s", err.Error())
+		return
+	}
+
+	current := m.Wpa.st().conn.get()
+	if len(networks) == 0 {
+		m.Wpa.st().conn.update(func(s *ConnStatus) {
+			s.State = ConnStateIdle
+			s.Ssid = ""
+			s.DisconnectedSince = time.Time{}
+		})
+		return
+	}
+
+	if current.DisconnectedSince.IsZero() {
+		current.DisconnectedSince = now
+		current.NextAttempt = now.Add(m.backoffMin)
+		m.Wpa.st().conn.update(func(s *ConnStatus) {
+			s.State = ConnStateDisconnected
+			s.DisconnectedSince = current.DisconnectedSince
+			s.NextAttempt = current.NextAttempt
+		})
+		return
+	}
+
+	// recover after recoveryAfter without connectivity, and again every
+	// recoveryAfter while the outage lasts
+	since := current.DisconnectedSince
+	if m.recoveredAt.After(since) {
+		since = m.recoveredAt
+	}
+	if now.Sub(since) >= m.recoveryAfter {
+		m.recover()
+		return
+	}
+
+	if now.Before(current.NextAttempt) {
+		return
+	}
+
+	network := m.nextNetwork(networks)
+
+	if m.attempt(network) {
+		m.check()
+		return
+	}
+
+	m.backoff *= 2
+	if m.backoff < m.backoffMin {
+		m.backoff = m.backoffMin
+	}
+	if m.backoff > m.backoffMax {
+		m.backoff = m.backoffMax
+	}
+
+	m.Wpa.st().conn.update(func(s *ConnStatus) {
+		s.State = ConnStateDisconnected
+		s.NextAttempt = time.Now().Add(m.backoff)
+	})
+}
+
+// attempt selects a network and waits for it to complete, afterwards all
+// saved networks are enabled again so wpa_supplicant can fall back on its
+// own.
+func (m *ConnManager) attempt(network SavedNetwork) bool {
+	m.Wpa.st().station.Lock()
+	defer m.Wpa.st().station.Unlock()
+
+	m.Log.Info(map[string]interface{}{"ssid": network.Ssid, "id": network.Id}, "Connection manager trying network")
+	m.Wpa.st().conn.update(func(s *ConnStatus) {
+		s.State = ConnStateConnecting
+		s.Ssid = network.Ssid
+		s.Attempts++
+	})
+
+	defer m.wpaCli("enable_network", "all")
+
+	// enable_network also clears a temporary disable after auth failures
+	if _, err := m.wpaCli("enable_network", network.Id); err != nil {
+		m.Log.Error("Could not enable network %s: %s", network.Id, err.Error())
+		return false
+	}
+	if _, err := m.wpaCli("select_network", network.Id); err != nil {
+		m.Log.Error("Could not select network %s: %s", network.Id, err.Error())
+		return false
+	}
+
+	deadline := time.Now().Add(m.attemptTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+
+		status, err := m.wpaStatus()
+		if err == nil && status["wpa_state"] == "COMPLETED" {
+			metricConnectAttempts.Inc("success", "reconnect")
+			return true
+		}
+	}
+
+	metricConnectAttempts.Inc("failure", "reconnect_timeout")
+	m.Log.Info(map[string]interface{}{"ssid": network.Ssid}, "Connection manager attempt timed out")
+
+	return false
+}
+
+// recover runs the configured recovery actions.
+func (m *ConnManager) recover() {
+	m.recoveredAt = time.Now()
+	m.Wpa.st().conn.update(func(s *ConnStatus) {
+		s.State = ConnStateRecovering
+		s.Recoveries++
+	})
+
+	for _, action := range m.actions {
+		fn, ok := m.Recover[action]
+		if !ok {
+			m.Log.Error("Unknown recovery action %s", action)
+			continue
+		}
+
+		m.Log.Info("Connection manager recovery: %s", action)
+		if err := fn(); err != nil {
+			m.Log.Error("Recovery action %s failed: %s", action, err.Error())
+		}
+	}
+
+	m.Wpa.st().conn.update(func(s *ConnStatus) {
+		s.State = ConnStateDisconnected
+		s.NextAttempt = time.Now().Add(m.backoffMin)
+	})
+}
+
+// wpaCli runs a wpa_cli command on wlan0 and checks for FAIL.
+func (m *ConnManager) wpaCli(args ...string) ([]byte, error) {
+	out, err := exec.Command("wpa_cli", append([]string{"-i", "wlan0"}, args...)...).Output()
+	if err != nil {
+		return out, err
+	}
+	if strings.TrimSpace(string(out)) == "FAIL" {
+		return out, fmt.Errorf("wpa_cli %s: FAIL", strings.Join(args, " "))
+	}
+
+	return out, nil
+}
+
+// wpaStatus returns wpa_cli status.
+func (m *ConnManager) wpaStatus() (map[string]string, error) {
+	out, err := m.wpaCli("status")
+	if err != nil {
+		return nil, err
+	}
+
+	return cfgMapper(out), nil
+}
+
+// nextNetwork returns the first network not attempted in this round,
+// starting a new round once all were. Networks are tracked by id, so a
+// new order after a success neither skips nor repeats one.
+func (m *ConnManager) nextNetwork(networks []SavedNetwork) SavedNetwork {
+	for _, network := range networks {
+		if !m.tried[network.Id] {
+			m.tried[network.Id] = true
+			return network
+		}
+	}
+
+	m.tried = map[string]bool{networks[0].Id: true}
+
+	return networks[0]
+}
+
+// savedNetworks lists saved networks by priority, then last success.
+func (m *ConnManager) savedNetworks() ([]SavedNetwork, error) {
+	out, err := m.wpaCli("list_networks")
+	if err != nil {
+		return nil, err
+	}
+
+	networks := parseListNetworks(out)
+	for i := range networks {
+		priority, err := m.wpaCli("get_network", networks[i].Id, "priority")
+		if err == nil {
+			networks[i].Priority, _ = strconv.Atoi(strings.TrimSpace(string(priority)))
+		}
+		networks[i].LastSuccess = m.lastSuccess[networks[i].Ssid]
+	}
+
+	sort.SliceStable(networks, func(i, j int) bool {
+		if networks[i].Priority != networks[j].Priority {
+			return networks[i].Priority > networks[j].Priority
+		}
+		return networks[i].LastSuccess.After(networks[j].LastSuccess)
+	})
+
+	return networks, nil
+}
+
+// parseListNetworks parses wpa_cli list_networks output, tab separated
+// id, ssid, bssid and flags after a header line.
+func parseListNetworks(data []byte) []SavedNetwork {
+	networks := []SavedNetwork{}
+
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+
+		network := SavedNetwork{Id: fields[0], Ssid: fields[1]}
+		if len(fields) > 3 {
+			network.Flags = fields[3]
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
@@ -0,0 +1,31 @@
+package iotwifi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConnManagerRotatesByNetwork(t *testing.T) {
+	m := NewConnManager(nil, &WpaCfg{}, ConnMgrCfg{}, nil)
+
+	a, b, c := SavedNetwork{Id: "0", Ssid: "a"}, SavedNetwork{Id: "1", Ssid: "b"}, SavedNetwork{Id: "2", Ssid: "c"}
+
+	// the order changes between attempts, as after a success of c
+	orders := [][]SavedNetwork{
+		{a, b, c},
+		{c, a, b},
+		{c, b, a},
+		{a, b, c},
+		{b, c, a},
+	}
+
+	got := []string{}
+	for _, networks := range orders {
+		got = append(got, m.nextNetwork(networks).Ssid)
+	}
+
+	want := []string{"a", "c", "b", "a", "b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("attempted %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package iotwifi
+
+import (
+	"context"
+)
+
+// contextKey is the type of context keys defined by this package.
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIdKey
+)
+
+// WithLogger returns a context carrying a request-scoped logger.
+func WithLogger(ctx context.Context, log Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, log)
+}
+
+// LoggerFromContext returns the logger set by WithLogger, or fallback.
+func LoggerFromContext(ctx context.Context, fallback Logger) Logger {
+	if log, ok := ctx.Value(loggerKey).(Logger); ok {
+		return log
+	}
+
+	return fallback
+}
+
+// WithRequestId returns a context carrying a request id.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey, id)
+}
+
+// RequestIdFromContext returns the request id set by WithRequestId.
+func RequestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// WithContext returns a copy of wpa logging to the request-scoped logger
+// of ctx, so log lines of the wpa_cli commands it runs carry the request
+// id. The copy shares the configuration and state of wpa.
+func (wpa *WpaCfg) WithContext(ctx context.Context) *WpaCfg {
+	return &WpaCfg{
+		Log:    LoggerFromContext(ctx, wpa.Log),
+		WpaCmd: wpa.WpaCmd,
+		WpaCfg: wpa.WpaCfg,
+		state:  wpa.st(),
+	}
+}
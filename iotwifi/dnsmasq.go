@@ -0,0 +1,282 @@
+package iotwifi
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDnsmasqConfFile  = "/var/run/txwifi/dnsmasq.conf"
+	defaultDnsmasqLeaseFile = "/var/lib/misc/dnsmasq.leases"
+	defaultDnsmasqResolv    = "/etc/resolv.conf"
+)
+
+// dhcpIpOptions are DHCP options that take IP addresses as values.
+var dhcpIpOptions = map[string]bool{
+	"3":          true,
+	"6":          true,
+	"router":     true,
+	"dns-server": true,
+}
+
+// confFile returns the location of the rendered dnsmasq configuration.
+func (c *DnsmasqCfg) confFile() string {
+	if c.ConfFile != "" {
+		return c.ConfFile
+	}
+
+	return defaultDnsmasqConfFile
+}
+
+// leaseFile returns the location of the dnsmasq lease database.
+func (c *DnsmasqCfg) leaseFile() string {
+	if c.LeaseFile != "" {
+		return c.LeaseFile
+	}
+
+	return defaultDnsmasqLeaseFile
+}
+
+// dhcpRange returns the dhcp-range value with the lease time applied
+// when the range does not specify one.
+func (c *DnsmasqCfg) dhcpRange() string {
+	if c.LeaseTime != "" && len(strings.Split(c.DhcpRange, ",")) == 2 {
+		return c.DhcpRange + "," + c.LeaseTime
+	}
+
+	return c.DhcpRange
+}
+
+// Render produces the dnsmasq configuration file contents, forwarding
+// DNS upstream when Forward is set.
+func (c *DnsmasqCfg) Render() string {
+	return c.render(c.Forward)
+}
+
+// render produces the configuration, forwarding DNS only with upstream
+// set, as forwarding without a connected station fails every query.
+func (c *DnsmasqCfg) render(upstream bool) string {
+	var b bytes.Buffer
+
+	line := func(key string, value string) {
+		if value == "" {
+			b.WriteString(key + "\n")
+			return
+		}
+		b.WriteString(key + "=" + value + "\n")
+	}
+
+	b.WriteString("# generated by txwifi, changes will be overwritten\n")
+	line("no-hosts", "")
+	line("log-queries", "")
+	line("log-dhcp", "")
+	line("log-facility", "-")
+	line("dhcp-authoritative", "")
+
+	// DNS forwarding
+	switch {
+	case !upstream:
+		line("no-resolv", "")
+	case len(c.Servers) > 0:
+		line("no-resolv", "")
+		for _, server := range c.Servers {
+			line("server", server)
+		}
+	default:
+		resolv := c.ResolvFile
+		if resolv == "" {
+			resolv = defaultDnsmasqResolv
+		}
+		line("resolv-file", resolv)
+	}
+
+	if c.Address != "" {
+		line("address", c.Address)
+	}
+	for _, address := range c.Addresses {
+		line("address", address)
+	}
+
+	// DHCP
+	line("dhcp-range", c.dhcpRange())
+	if c.VendorClass != "" {
+		line("dhcp-vendorclass", c.VendorClass)
+	}
+	line("dhcp-leasefile", c.leaseFile())
+
+	for _, host := range c.DhcpHosts {
+		fields := []string{host.Mac, host.Ip}
+		if host.Hostname != "" {
+			fields = append(fields, host.Hostname)
+		}
+		if host.LeaseTime != "" {
+			fields = append(fields, host.LeaseTime)
+		}
+		line("dhcp-host", strings.Join(fields, ","))
+	}
+
+	for _, opt := range c.DhcpOptions {
+		fields := []string{}
+		if opt.Tag != "" {
+			fields = append(fields, "tag:"+opt.Tag)
+		}
+		if _, err := strconv.Atoi(opt.Option); err == nil {
+			fields = append(fields, opt.Option)
+		} else {
+			fields = append(fields, "option:"+opt.Option)
+		}
+		fields = append(fields, opt.Value)
+		line("dhcp-option", strings.Join(fields, ","))
+	}
+
+	return b.String()
+}
+
+// Validate checks the dnsmasq configuration against the AP subnet, see
+// HostApdCfg.Netmask, returning ValidationErrors for every invalid field.
+func (c *DnsmasqCfg) Validate(ap *HostApdCfg) error {
+	errs := ValidationErrors{}
+	fail := func(field string, format string, a ...interface{}) {
+		errs = append(errs, FieldError{Field: "dnsmasq_cfg." + field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	subnet, err := ap.subnet()
+	if err != nil {
+		fail("", "invalid AP subnet: %s", err.Error())
+		return errs
+	}
+
+	// every value is rendered on a line of its own
+	oneLine := func(field string, values ...string) {
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				fail(field, "%q must not contain line breaks", value)
+			}
+		}
+	}
+	oneLine("address", c.Address)
+	oneLine("dhcp_range", c.DhcpRange)
+	oneLine("vendor_class", c.VendorClass)
+	oneLine("addresses", c.Addresses...)
+	oneLine("servers", c.Servers...)
+	oneLine("resolv_file", c.ResolvFile)
+	oneLine("lease_time", c.LeaseTime)
+	oneLine("lease_file", c.LeaseFile)
+	for _, host := range c.DhcpHosts {
+		oneLine("dhcp_hosts", host.Mac, host.Ip, host.Hostname, host.LeaseTime)
+	}
+	for _, opt := range c.DhcpOptions {
+		oneLine("dhcp_options", opt.Tag, opt.Option, opt.Value)
+	}
+
+	inSubnet := func(field string, value string) bool {
+		addr := net.ParseIP(value)
+		if addr == nil {
+			fail(field, "%q is not an ip address", value)
+			return false
+		}
+		if !subnet.Contains(addr) {
+			fail(field, "%s is outside the AP subnet %s", value, subnet)
+			return false
+		}
+		return true
+	}
+
+	rng := strings.Split(c.DhcpRange, ",")
+	if len(rng) < 2 {
+		fail("dhcp_range", "requires a start and end address")
+	} else {
+		rng[0], rng[1] = strings.TrimSpace(rng[0]), strings.TrimSpace(rng[1])
+		startOk := inSubnet("dhcp_range", rng[0])
+		endOk := inSubnet("dhcp_range", rng[1])
+		if startOk && endOk && bytes.Compare(net.ParseIP(rng[0]).To4(), net.ParseIP(rng[1]).To4()) > 0 {
+			fail("dhcp_range", "start %s is after end %s", rng[0], rng[1])
+		}
+	}
+
+	if c.Forward && strings.HasPrefix(c.Address, "/#/") {
+		fail("address", "/#/ answers every query, remove it to forward DNS")
+	}
+
+	addresses := c.Addresses
+	if c.Address != "" {
+		addresses = append([]string{c.Address}, addresses...)
+	}
+	for _, address := range addresses {
+		parts := strings.Split(address, "/")
+		if len(parts) != 3 || parts[0] != "" || parts[1] == "" {
+			fail("addresses", "%q must look like /domain/ip", address)
+			continue
+		}
+		if net.ParseIP(parts[2]) == nil {
+			fail("addresses", "%q has an invalid ip", address)
+		}
+	}
+
+	for _, server := range c.Servers {
+		// plain servers only, /domain/ip and ip#port forms are passed as-is
+		if strings.ContainsAny(server, "/#") {
+			continue
+		}
+		if net.ParseIP(server) == nil {
+			fail("servers", "%q is not an ip address", server)
+		}
+	}
+
+	for _, host := range c.DhcpHosts {
+		if _, err := net.ParseMAC(host.Mac); err != nil {
+			fail("dhcp_hosts", "mac %q: %s", host.Mac, err.Error())
+		}
+		inSubnet("dhcp_hosts", host.Ip)
+	}
+
+	for _, opt := range c.DhcpOptions {
+		if opt.Option == "" {
+			fail("dhcp_options", "entry is missing an option")
+			continue
+		}
+		if dhcpIpOptions[opt.Option] {
+			for _, value := range strings.Split(opt.Value, ",") {
+				if net.ParseIP(strings.TrimSpace(value)) == nil {
+					fail("dhcp_options", "%s value %q is not an ip address", opt.Option, value)
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// writeConf renders the configuration to its conf file, see render.
+func (c *DnsmasqCfg) writeConf(upstream bool) (string, error) {
+	confFile := c.confFile()
+
+	if err := os.MkdirAll(filepath.Dir(confFile), 0755); err != nil {
+		return confFile, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.leaseFile()), 0755); err != nil {
+		return confFile, err
+	}
+
+	return confFile, ioutil.WriteFile(confFile, []byte(c.render(upstream)), 0644)
+}
+
+// stationConnected reports whether wpa_supplicant completed a connection,
+// so DNS can be forwarded.
+func stationConnected() bool {
+	stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
+
+	return err == nil && cfgMapper(stateOut)["wpa_state"] == "COMPLETED"
+}
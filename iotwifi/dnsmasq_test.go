@@ -0,0 +1,79 @@
+package iotwifi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDnsmasqCfgValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ap      HostApdCfg
+		cfg     DnsmasqCfg
+		wantErr string
+	}{
+		{
+			name: "default /24",
+			ap:   HostApdCfg{Ip: "192.168.27.1"},
+			cfg:  DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150,1h"},
+		},
+		{
+			name: "/24 in 10.0.0.0/8",
+			ap:   HostApdCfg{Ip: "10.1.2.1", Netmask: "24"},
+			cfg:  DnsmasqCfg{DhcpRange: "10.1.2.100,10.1.2.150"},
+		},
+		{
+			name:    "outside the /24 in 10.0.0.0/8",
+			ap:      HostApdCfg{Ip: "10.1.2.1", Netmask: "255.255.255.0"},
+			cfg:     DnsmasqCfg{DhcpRange: "10.1.3.100,10.1.3.150"},
+			wantErr: "outside the AP subnet 10.1.2.0/24",
+		},
+		{
+			name: "/16 mask",
+			ap:   HostApdCfg{Ip: "172.16.0.1", Netmask: "255.255.0.0"},
+			cfg:  DnsmasqCfg{DhcpRange: "172.16.1.100,172.16.2.150"},
+		},
+		{
+			name:    "bad netmask",
+			ap:      HostApdCfg{Ip: "192.168.27.1", Netmask: "255.0.255.0"},
+			cfg:     DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150"},
+			wantErr: "invalid AP subnet",
+		},
+		{
+			name:    "server newline",
+			ap:      HostApdCfg{Ip: "192.168.27.1"},
+			cfg:     DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150", Servers: []string{"8.8.8.8/\ndhcp-script=/tmp/x"}},
+			wantErr: "dnsmasq_cfg.servers",
+		},
+		{
+			name:    "address newline",
+			ap:      HostApdCfg{Ip: "192.168.27.1"},
+			cfg:     DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150", Address: "/#/192.168.27.1\nport=0"},
+			wantErr: "dnsmasq_cfg.address",
+		},
+		{
+			name: "dhcp host newline",
+			ap:   HostApdCfg{Ip: "192.168.27.1"},
+			cfg: DnsmasqCfg{
+				DhcpRange: "192.168.27.100,192.168.27.150",
+				DhcpHosts: []DnsmasqHost{{Mac: "b8:27:eb:00:00:01", Ip: "192.168.27.10", Hostname: "sensor\r\nno-resolv"}},
+			},
+			wantErr: "dnsmasq_cfg.dhcp_hosts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate(&tt.ap)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
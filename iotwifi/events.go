@@ -0,0 +1,146 @@
+package iotwifi
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Event types parsed from child process output.
+const (
+	EventDhcpAck         = "dhcp.ack"
+	EventDhcpVendorClass = "dhcp.vendor_class"
+	EventDhcpTags        = "dhcp.tags"
+	EventApEnabled       = "ap.enabled"
+	EventApDisabled      = "ap.disabled"
+	EventApStaConnected  = "ap.sta_connected"
+	EventApStaDisconnect = "ap.sta_disconnected"
+	EventStaConnected    = "sta.connected"
+	EventStaDisconnected = "sta.disconnected"
+)
+
+// Event is a meaningful line of child process output. Type is one of the
+// Event* constants, or sta.<name> for other wpa_supplicant CTRL-EVENT-*
+// lines. Raw is the line the event was parsed from.
+type Event struct {
+	Type     string            `json:"type"`
+	Source   string            `json:"source"`
+	Time     time.Time         `json:"time"`
+	Mac      string            `json:"mac,omitempty"`
+	Ip       string            `json:"ip,omitempty"`
+	Hostname string            `json:"hostname,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Raw      string            `json:"raw"`
+}
+
+var (
+	dhcpEventR      = regexp.MustCompile(`(\d+) (DHCPACK)\((\S+)\) (\S+) (\S+)(?: (\S+))?`)
+	hostapdEventR   = regexp.MustCompile(`(?:(\S+): )?(AP-ENABLED|AP-DISABLED|AP-STA-CONNECTED|AP-STA-DISCONNECTED)(?: (\S+))?`)
+	ctrlEventR      = regexp.MustCompile(`CTRL-EVENT-([A-Z0-9-]+)(.*)$`)
+	ctrlFieldR      = regexp.MustCompile(`([a-z_]+)=("[^"]*"|[^\s\]]*)`)
+	ctrlConnectedR  = regexp.MustCompile(`Connection to (\S+) completed`)
+	hostapdEventMap = map[string]string{
+		"AP-ENABLED":          EventApEnabled,
+		"AP-DISABLED":         EventApDisabled,
+		"AP-STA-CONNECTED":    EventApStaConnected,
+		"AP-STA-DISCONNECTED": EventApStaDisconnect,
+	}
+)
+
+// eventParsers parse lines of output by command id.
+var eventParsers = map[string]func(line string) (Event, bool){
+	"dnsmasq":        parseDnsmasqEvent,
+	"hostapd":        parseHostapdOutput,
+	"wpa_supplicant": parseSupplicantEvent,
+}
+
+// ParseEvent parses a line of output of the command id, ok is false for
+// lines that are not events.
+func ParseEvent(id string, line string) (Event, bool) {
+	parser, ok := eventParsers[id]
+	if !ok {
+		return Event{}, false
+	}
+
+	event, ok := parser(line)
+	if !ok {
+		return Event{}, false
+	}
+
+	event.Source = id
+	event.Time = time.Now()
+	event.Raw = line
+
+	return event, true
+}
+
+// parseDnsmasqEvent parses dnsmasq log-dhcp output, DHCPACK lines and the
+// vendor class and tags logged per transaction id before them.
+func parseDnsmasqEvent(line string) (Event, bool) {
+	if m := dhcpEventR.FindStringSubmatch(line); m != nil {
+		return Event{
+			Type:     EventDhcpAck,
+			Ip:       m[4],
+			Mac:      strings.ToLower(m[5]),
+			Hostname: m[6],
+			Fields:   map[string]string{"xid": m[1], "interface": m[3]},
+		}, true
+	}
+
+	if m := dhcpVendorR.FindStringSubmatch(line); m != nil {
+		return Event{
+			Type:   EventDhcpVendorClass,
+			Fields: map[string]string{"xid": m[1], "vendor_class": strings.TrimSpace(m[2])},
+		}, true
+	}
+
+	if m := dhcpTagsR.FindStringSubmatch(line); m != nil {
+		return Event{
+			Type:   EventDhcpTags,
+			Fields: map[string]string{"xid": m[1], "tags": strings.Replace(m[2], " ", "", -1)},
+		}, true
+	}
+
+	return Event{}, false
+}
+
+// parseHostapdOutput parses hostapd AP and station events.
+func parseHostapdOutput(line string) (Event, bool) {
+	m := hostapdEventR.FindStringSubmatch(line)
+	if m == nil {
+		return Event{}, false
+	}
+
+	return Event{
+		Type:   hostapdEventMap[m[2]],
+		Mac:    strings.ToLower(m[3]),
+		Fields: map[string]string{"interface": m[1]},
+	}, true
+}
+
+// parseSupplicantEvent parses wpa_supplicant CTRL-EVENT-* lines, key=value
+// pairs become fields.
+func parseSupplicantEvent(line string) (Event, bool) {
+	m := ctrlEventR.FindStringSubmatch(line)
+	if m == nil {
+		return Event{}, false
+	}
+
+	event := Event{
+		Type:   "sta." + strings.ToLower(strings.Replace(m[1], "-", "_", -1)),
+		Fields: make(map[string]string),
+	}
+
+	for _, field := range ctrlFieldR.FindAllStringSubmatch(m[2], -1) {
+		event.Fields[field[1]] = strings.Trim(field[2], `"`)
+	}
+
+	if c := ctrlConnectedR.FindStringSubmatch(m[2]); c != nil {
+		event.Fields["bssid"] = c[1]
+	}
+	if bssid, ok := event.Fields["bssid"]; ok {
+		event.Mac = strings.ToLower(bssid)
+	}
+
+	return event, true
+}
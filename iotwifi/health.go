@@ -0,0 +1,89 @@
+package iotwifi
+
+import (
+	"time"
+)
+
+// Health check statuses.
+const (
+	HealthOK   = "OK"
+	HealthFail = "FAIL"
+)
+
+// HealthCheck is the result of checking one component.
+type HealthCheck struct {
+	Name     string     `json:"name"`
+	Status   string     `json:"status"`
+	Message  string     `json:"message"`
+	Duration string     `json:"duration"`
+	Process  *ProcState `json:"process,omitempty"`
+}
+
+// Health is the detailed health of the service.
+type Health struct {
+	Status    string            `json:"status"`
+	BootPhase string            `json:"boot_phase"`
+	Failures  map[string]string `json:"boot_failures"`
+	Checks    []HealthCheck     `json:"checks"`
+}
+
+// checkComponent checks that a supervised process of procs is running
+// and responds to check.
+func checkComponent(procs *processTable, name string, check func() error) HealthCheck {
+	start := time.Now()
+	result := HealthCheck{Name: name, Status: HealthOK}
+
+	proc, ok := procs.get(name)
+	if ok {
+		result.Process = &proc
+	}
+
+	var err error
+	switch {
+	case !ok:
+		result.Status = HealthFail
+		result.Message = "not started"
+	case !proc.Running:
+		result.Status = HealthFail
+		result.Message = "not running"
+	default:
+		err = check()
+	}
+
+	if err != nil {
+		result.Status = HealthFail
+		result.Message = err.Error()
+	}
+
+	result.Duration = time.Since(start).String()
+
+	return result
+}
+
+// Health checks that hostapd, wpa_supplicant and dnsmasq are running and
+// responsive. Status is HealthOK only when every check passes.
+func (wpa *WpaCfg) Health() Health {
+	st := wpa.st()
+	phase, failures := st.boot.get()
+
+	health := Health{
+		Status:    HealthOK,
+		BootPhase: phase,
+		Failures:  failures,
+		Checks: []HealthCheck{
+			checkComponent(st.procs, "hostapd", apReady),
+			checkComponent(st.procs, "wpa_supplicant", supplicantReady),
+			checkComponent(st.procs, "dnsmasq", func() error {
+				return dnsmasqReady(wpa.WpaCfg.Load().HostApdCfg.Ip)
+			}),
+		},
+	}
+
+	for _, check := range health.Checks {
+		if check.Status != HealthOK {
+			health.Status = HealthFail
+		}
+	}
+
+	return health
+}
@@ -0,0 +1,434 @@
+package iotwifi
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hostapdTimeout bounds a single control interface request.
+	hostapdTimeout = 10 * time.Second
+
+	defaultHostapdCfgFile = "/var/run/txwifi/hostapd.conf"
+	defaultApNetmask      = "255.255.255.0"
+)
+
+// subnet returns the AP subnet of Ip and Netmask, a dotted mask or a
+// prefix length, 255.255.255.0 by default.
+func (c *HostApdCfg) subnet() (*net.IPNet, error) {
+	ip := net.ParseIP(c.Ip).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IPv4 address", c.Ip)
+	}
+
+	netmask := c.Netmask
+	if netmask == "" {
+		netmask = defaultApNetmask
+	}
+
+	var mask net.IPMask
+	if bits, err := strconv.Atoi(netmask); err == nil {
+		if bits < 1 || bits > 30 {
+			return nil, fmt.Errorf("prefix length %d is not 1 to 30", bits)
+		}
+		mask = net.CIDRMask(bits, 32)
+	} else if m := net.ParseIP(netmask).To4(); m != nil {
+		mask = net.IPMask(m)
+		if ones, bits := mask.Size(); bits == 0 || ones < 1 || ones > 30 {
+			return nil, fmt.Errorf("%q is not a contiguous netmask of 1 to 30 bits", netmask)
+		}
+	} else {
+		return nil, fmt.Errorf("%q is not a netmask or prefix length", netmask)
+	}
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// checkSsid checks an 802.11 SSID: 1 to 32 bytes without control
+// characters, which would end its line of the hostapd configuration.
+func checkSsid(ssid string) error {
+	if n := len(ssid); n < 1 || n > 32 {
+		return fmt.Errorf("must be 1 to 32 bytes, got %d", n)
+	}
+
+	for _, r := range ssid {
+		if r < 32 || r == 127 {
+			return errors.New("must not contain control characters")
+		}
+	}
+
+	return nil
+}
+
+// checkPassphrase checks a WPA passphrase: 8 to 63 printable ASCII
+// characters or a 64 hex digit PSK.
+func checkPassphrase(passphrase string) error {
+	n := len(passphrase)
+
+	if n == 64 {
+		if _, err := hex.DecodeString(passphrase); err != nil {
+			return errors.New("a 64 character PSK must be hex digits")
+		}
+		return nil
+	}
+
+	if n < 8 || n > 63 {
+		return fmt.Errorf("WPA2 requires 8 to 63 characters or 64 hex digits, got %d", n)
+	}
+
+	for _, r := range passphrase {
+		if r < 32 || r > 126 {
+			return errors.New("must be printable ASCII")
+		}
+	}
+
+	return nil
+}
+
+// Render produces the hostapd configuration file contents. The ssid and
+// passphrase must pass checkSsid and checkPassphrase.
+func (c *HostApdCfg) Render() string {
+	return `interface=uap0
+ctrl_interface=` + hostapdCtrlDir + `
+ssid=` + c.Ssid + `
+hw_mode=g
+channel=` + c.Channel + `
+macaddr_acl=0
+auth_algs=1
+ignore_broadcast_ssid=0
+wpa=2
+wpa_passphrase=` + c.WpaPassphrase + `
+wpa_key_mgmt=WPA-PSK
+wpa_pairwise=TKIP
+rsn_pairwise=CCMP
+`
+}
+
+// writeConf renders the configuration to its cfg file.
+func (c *HostApdCfg) writeConf() (string, error) {
+	cfgFile := c.CfgFile
+	if cfgFile == "" {
+		cfgFile = defaultHostapdCfgFile
+	}
+
+	// expanded templates are only checked here
+	if err := checkSsid(c.Ssid); err != nil {
+		return cfgFile, errors.New("host_apd_cfg.ssid: " + err.Error())
+	}
+	if err := checkPassphrase(c.WpaPassphrase); err != nil {
+		return cfgFile, errors.New("host_apd_cfg.wpa_passphrase: " + err.Error())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfgFile), 0755); err != nil {
+		return cfgFile, err
+	}
+
+	// the passphrase is in the file
+	return cfgFile, ioutil.WriteFile(cfgFile, []byte(c.Render()), 0600)
+}
+
+// hostapdLocalSeq makes local socket names unique within the process.
+var hostapdLocalSeq uint64
+
+// HostapdCtrl is a client for the hostapd control interface, a unix
+// datagram socket at <ctrl_interface>/<interface>.
+type HostapdCtrl struct {
+	mu    sync.Mutex
+	conn  *net.UnixConn
+	local string
+}
+
+// HostapdEvent is an unsolicited message from an attached control
+// interface connection, e.g. "AP-STA-CONNECTED 5c:cf:7f:01:02:03".
+type HostapdEvent struct {
+	Level int    `json:"level"`
+	Type  string `json:"type"`
+	Mac   string `json:"mac"`
+	Raw   string `json:"raw"`
+}
+
+// DialHostapd connects to the control interface of a hostapd interface.
+func DialHostapd(iface string) (*HostapdCtrl, error) {
+	remote := filepath.Join(hostapdCtrlDir, iface)
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("txwifi_hostapd_%d_%d", os.Getpid(), atomic.AddUint64(&hostapdLocalSeq, 1)))
+
+	// a stale socket from an earlier process with the same pid
+	os.Remove(local)
+
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: remote, Net: "unixgram"},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HostapdCtrl{conn: conn, local: local}, nil
+}
+
+// Close closes the connection and removes the local socket.
+func (h *HostapdCtrl) Close() error {
+	err := h.conn.Close()
+	os.Remove(h.local)
+
+	return err
+}
+
+// Request sends a command and returns the reply. Unsolicited event
+// messages received while waiting are skipped.
+func (h *HostapdCtrl) Request(cmd string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.conn.SetDeadline(time.Now().Add(hostapdTimeout))
+	defer h.conn.SetDeadline(time.Time{})
+
+	if _, err := h.conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, err := h.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		reply := string(buf[:n])
+		if strings.HasPrefix(reply, "<") {
+			continue
+		}
+
+		return reply, nil
+	}
+}
+
+// requestOK sends a command that replies OK or FAIL.
+func (h *HostapdCtrl) requestOK(cmd string) error {
+	reply, err := h.Request(cmd)
+	if err != nil {
+		return err
+	}
+
+	reply = strings.TrimSpace(reply)
+	if reply != "OK" {
+		// only the command name, SET values may hold a passphrase
+		return errors.New("hostapd: " + strings.Fields(cmd)[0] + ": " + reply)
+	}
+
+	return nil
+}
+
+// Attach registers the connection as an event monitor. Requests should
+// be made on a separate connection once attached.
+func (h *HostapdCtrl) Attach() error {
+	return h.requestOK("ATTACH")
+}
+
+// Events calls handler for each event received on an attached
+// connection and blocks until the connection is closed.
+func (h *HostapdCtrl) Events(handler func(HostapdEvent)) error {
+	buf := make([]byte, 8192)
+	for {
+		n, err := h.conn.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		if event, ok := parseHostapdEvent(string(buf[:n])); ok {
+			handler(event)
+		}
+	}
+}
+
+// parseHostapdEvent parses "<3>AP-STA-CONNECTED 5c:cf:7f:01:02:03".
+func parseHostapdEvent(msg string) (HostapdEvent, bool) {
+	event := HostapdEvent{Raw: strings.TrimSpace(msg)}
+
+	if !strings.HasPrefix(msg, "<") {
+		return event, false
+	}
+
+	end := strings.Index(msg, ">")
+	if end < 0 {
+		return event, false
+	}
+
+	fmt.Sscanf(msg[1:end], "%d", &event.Level)
+
+	fields := strings.Fields(msg[end+1:])
+	if len(fields) == 0 {
+		return event, false
+	}
+
+	event.Type = fields[0]
+	for _, field := range fields[1:] {
+		if hw, err := net.ParseMAC(field); err == nil {
+			event.Mac = hw.String()
+			break
+		}
+	}
+
+	return event, true
+}
+
+// hostapdRequest runs a single request on a new AP control connection.
+func hostapdRequest(cmd string) (string, error) {
+	ctrl, err := DialHostapd("uap0")
+	if err != nil {
+		return "", err
+	}
+	defer ctrl.Close()
+
+	return ctrl.Request(cmd)
+}
+
+// hostapdRequestOK runs a single OK/FAIL request on a new AP control
+// connection.
+func hostapdRequestOK(cmds ...string) error {
+	ctrl, err := DialHostapd("uap0")
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	for _, cmd := range cmds {
+		if err := ctrl.requestOK(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hostapdAllSta returns the station list in the format of hostapd_cli
+// all_sta, walking it with STA-FIRST and STA-NEXT.
+func hostapdAllSta() ([]byte, error) {
+	ctrl, err := DialHostapd("uap0")
+	if err != nil {
+		return nil, err
+	}
+	defer ctrl.Close()
+
+	all := []string{}
+	reply, err := ctrl.Request("STA-FIRST")
+	for err == nil && reply != "" && !strings.HasPrefix(reply, "FAIL") {
+		all = append(all, reply)
+
+		mac := strings.TrimSpace(strings.SplitN(reply, "\n", 2)[0])
+		reply, err = ctrl.Request("STA-NEXT " + mac)
+	}
+
+	return []byte(strings.Join(all, "\n")), err
+}
+
+// ApStatus returns the hostapd STATUS of the AP interface.
+func (wpa *WpaCfg) ApStatus() (map[string]string, error) {
+	statusOut, err := hostapdRequest("STATUS")
+	if err != nil {
+		return nil, err
+	}
+
+	return cfgMapper([]byte(statusOut)), nil
+}
+
+// SetApCredentials changes the AP ssid and passphrase without restarting
+// hostapd and records them in the shared configuration. Empty values are
+// left unchanged.
+func (wpa *WpaCfg) SetApCredentials(ssid string, passphrase string) error {
+	if ssid != "" {
+		if err := checkSsid(ssid); err != nil {
+			return errors.New("hostapd: ssid " + err.Error())
+		}
+	}
+	if passphrase != "" {
+		if err := checkPassphrase(passphrase); err != nil {
+			return errors.New("hostapd: wpa_passphrase " + err.Error())
+		}
+	}
+
+	cmds := []string{}
+	if ssid != "" {
+		cmds = append(cmds, "SET ssid "+ssid)
+	}
+	if passphrase != "" {
+		cmds = append(cmds, "SET wpa_passphrase "+passphrase)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	err := hostapdRequestOK(append(cmds, "RELOAD")...)
+	if err != nil {
+		return err
+	}
+
+	setupCfg := wpa.WpaCfg.Update(func(c *SetupCfg) {
+		if ssid != "" {
+			c.HostApdCfg.Ssid = ssid
+		}
+		if passphrase != "" {
+			c.HostApdCfg.WpaPassphrase = passphrase
+		}
+	})
+	wpa.Log.Info("Hostapd reloaded with ssid %s", setupCfg.HostApdCfg.Ssid)
+
+	return nil
+}
+
+// EnableAp enables the AP interface of a running hostapd.
+func (wpa *WpaCfg) EnableAp() error {
+	wpa.Log.Info("Hostapd ENABLE")
+
+	err := hostapdRequestOK("ENABLE")
+	if err == nil {
+		wpa.st().ap.set(ApStateEnabled, nil)
+	}
+
+	return err
+}
+
+// DisableAp disables the AP interface without stopping hostapd.
+func (wpa *WpaCfg) DisableAp() error {
+	wpa.Log.Info("Hostapd DISABLE")
+
+	err := hostapdRequestOK("DISABLE")
+	if err == nil {
+		wpa.st().ap.set(ApStateDisabled, nil)
+	}
+
+	return err
+}
+
+// HostapdEvents calls handler for AP-STA-CONNECTED, AP-STA-DISCONNECTED
+// and other hostapd events until the returned connection is closed.
+func (wpa *WpaCfg) HostapdEvents(handler func(HostapdEvent)) (*HostapdCtrl, error) {
+	ctrl, err := DialHostapd("uap0")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctrl.Attach(); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	go func() {
+		err := ctrl.Events(handler)
+		if err != nil {
+			wpa.Log.Debug("Hostapd event monitor stopped: %s", err.Error())
+		}
+	}()
+
+	return ctrl, nil
+}
@@ -0,0 +1,60 @@
+package iotwifi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckApCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		ssid       string
+		passphrase string
+		wantErr    string
+	}{
+		{name: "valid", ssid: "iot-wifi", passphrase: "iotwifipass"},
+		{name: "hex psk", ssid: "iot-wifi", passphrase: strings.Repeat("0a", 32)},
+		{name: "ssid 32 bytes", ssid: strings.Repeat("s", 32), passphrase: "iotwifipass"},
+		{name: "empty ssid", ssid: "", passphrase: "iotwifipass", wantErr: "ssid"},
+		{name: "long ssid", ssid: strings.Repeat("s", 33), passphrase: "iotwifipass", wantErr: "ssid"},
+		{name: "ssid newline", ssid: "iot\nwpa=0", passphrase: "iotwifipass", wantErr: "ssid"},
+		{name: "ssid carriage return", ssid: "iot\rwifi", passphrase: "iotwifipass", wantErr: "ssid"},
+		{name: "short passphrase", ssid: "iot-wifi", passphrase: "short", wantErr: "wpa_passphrase"},
+		{name: "long passphrase", ssid: "iot-wifi", passphrase: strings.Repeat("p", 65), wantErr: "wpa_passphrase"},
+		{name: "64 non hex", ssid: "iot-wifi", passphrase: strings.Repeat("g", 64), wantErr: "wpa_passphrase"},
+		{name: "passphrase newline", ssid: "iot-wifi", passphrase: "iotwifi\nctrl_interface=/tmp", wantErr: "wpa_passphrase"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &SetupCfg{
+				HostApdCfg:       HostApdCfg{Ssid: tt.ssid, WpaPassphrase: tt.passphrase, Ip: "192.168.27.1", Channel: "6"},
+				DnsmasqCfg:       DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150"},
+				WpaSupplicantCfg: WpaSupplicantCfg{CfgFile: "/etc/wpa_supplicant/wpa_supplicant.conf"},
+			}
+
+			var fields []string
+			if errs, ok := c.validate(false).(ValidationErrors); ok {
+				for _, e := range errs {
+					fields = append(fields, e.Field)
+				}
+			}
+
+			got := strings.Join(fields, ",")
+			switch {
+			case tt.wantErr == "" && got != "":
+				t.Errorf("got invalid fields %s", got)
+			case tt.wantErr != "" && got != "host_apd_cfg."+tt.wantErr:
+				t.Errorf("got invalid fields %q, want host_apd_cfg.%s", got, tt.wantErr)
+			}
+
+			wpa := &WpaCfg{WpaCfg: NewSharedCfg(&SetupCfg{})}
+			// an empty ssid leaves it unchanged
+			if tt.wantErr != "" && tt.ssid != "" {
+				if err := wpa.SetApCredentials(tt.ssid, tt.passphrase); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("SetApCredentials: got error %v, want %s", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
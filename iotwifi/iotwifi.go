@@ -6,24 +6,49 @@ package iotwifi
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
+	"sync"
 	"time"
-
-	"github.com/bhoriuchi/go-bunyan/bunyan"
 )
 
-// CmdRunner runs internal commands allows output handlers to be attached.
+// CmdRunner runs internal commands and publishes their output on Bus,
+// handlers are attached with HandleFunc. Create it with NewCmdRunner,
+// copies share the running commands.
 type CmdRunner struct {
-	Log      bunyan.Logger
-	Messages chan CmdMessage
-	Handlers map[string]func(CmdMessage)
+	Log      Logger
+	Bus      *EventBus
 	Commands map[string]*exec.Cmd
+
+	// running guards Commands and signals their exits
+	running *runningCmds
+
+	// state records the processes
+	state *deviceState
+}
+
+// runningCmds tracks the commands started by a CmdRunner.
+type runningCmds struct {
+	mu     sync.Mutex
+	exited map[*exec.Cmd]chan struct{}
+}
+
+// stopTimeout limits how long stop waits for a killed command to exit.
+const stopTimeout = 5 * time.Second
+
+// NewCmdRunner returns a CmdRunner publishing command output on bus.
+func NewCmdRunner(log Logger, bus *EventBus) CmdRunner {
+	return CmdRunner{
+		Log:      orNop(log),
+		Bus:      bus,
+		Commands: make(map[string]*exec.Cmd),
+		running:  &runningCmds{exited: make(map[*exec.Cmd]chan struct{})},
+		state:    newDeviceState(bus),
+	}
 }
 
 // CmdMessage structures command output.
@@ -32,173 +57,228 @@ type CmdMessage struct {
 	Command string
 	Message string
 	Error   bool
+	Event   *Event
 	Cmd     *exec.Cmd
 	Stdin   *io.WriteCloser
 }
 
-// loadCfg loads the configuration.
-func loadCfg(cfgLocation string) (*SetupCfg, error) {
+// LoadCfg loads the configuration from a file or url.
+func LoadCfg(cfgLocation string) (*SetupCfg, error) {
+	return loadCfg(cfgLocation, nil)
+}
+
+// loadCfg loads the configuration and expands the AP templates, recording
+// the status of a remote fetch in remote.
+func loadCfg(cfgLocation string, remote *remoteStatus) (*SetupCfg, error) {
+	v, err := readCfg(cfgLocation, remote)
+	if err != nil {
+		return v, err
+	}
+
+	// per-device ssid and passphrase
+	err = expandApTemplates(&v.HostApdCfg)
+
+	return v, err
+}
+
+// urlDelimR matches configuration locations that are urls.
+var urlDelimR = regexp.MustCompile("://")
+
+// isUrl reports whether a configuration location is a url.
+func isUrl(cfgLocation string) bool {
+	return urlDelimR.MatchString(cfgLocation)
+}
+
+// readCfg reads the configuration from a file or url in JSON, YAML or
+// TOML, then applies the environment overrides. Unknown fields are
+// errors. Urls are fetched as configured by RemoteCfgFromEnv, the status
+// of the fetch is recorded in remote.
+func readCfg(cfgLocation string, remote *remoteStatus) (*SetupCfg, error) {
+	return readCfgFrom(cfgLocation, true, remote)
+}
+
+// readCfgFrom is readCfg, without cached set urls are fetched without
+// the cache file.
+func readCfgFrom(cfgLocation string, cached bool, status *remoteStatus) (*SetupCfg, error) {
 
 	v := &SetupCfg{}
-	var jsonData []byte
 
-	urlDelimR, _ := regexp.Compile("://")
-	isUrl := urlDelimR.Match([]byte(cfgLocation))
+	decode := func(data []byte, contentType string) error {
+		v = &SetupCfg{}
+		return decodeCfg(data, cfgFormat(cfgLocation, contentType), v)
+	}
 
 	// if not a url
-	if !isUrl {
+	if !isUrl(cfgLocation) {
 		fileData, err := ioutil.ReadFile(cfgLocation)
 		if err != nil {
-			panic(err)
+			return v, err
+		}
+		if err := decode(fileData, ""); err != nil {
+			return v, err
 		}
-		jsonData = fileData
 	}
 
-	if isUrl {
-		res, err := http.Get(cfgLocation)
+	if isUrl(cfgLocation) {
+		remote, err := RemoteCfgFromEnv()
 		if err != nil {
-			panic(err)
+			return v, err
+		}
+		if !cached {
+			remote.CacheFile = ""
 		}
 
-		defer res.Body.Close()
-
-		urlData, err := ioutil.ReadAll(res.Body)
+		fetched, err := remote.fetch(cfgLocation, decode)
+		status.set(fetched)
 		if err != nil {
-			panic(err)
+			return v, err
 		}
-
-		jsonData = urlData
 	}
 
-	err := json.Unmarshal(jsonData, v)
+	if err := v.applyEnv(); err != nil {
+		return v, err
+	}
 
-	return v, err
+	return v, nil
 }
 
-// RunWifi starts AP and Station modes.
-func RunWifi(log bunyan.Logger, messages chan CmdMessage, cfgLocation string) {
+// RunWifi loads the configuration, starts a Service for it and blocks.
+// Command output and events are published on the bus returned by
+// Service.Events, publishing a CmdMessage on TopicCmd+"kill" there exits
+// the process.
+func RunWifi(log Logger, cfgLocation string) {
 
 	log.Info("Loading IoT Wifi...")
 
-	cmdRunner := CmdRunner{
-		Log:      log,
-		Messages: messages,
-		Handlers: make(map[string]func(cmsg CmdMessage), 0),
-		Commands: make(map[string]*exec.Cmd, 0),
-	}
-
-	setupCfg, err := loadCfg(cfgLocation)
+	setupCfg, err := loadCfg(cfgLocation, nil)
 	if err != nil {
 		log.Error("Could not load config: %s", err.Error())
 		return
 	}
 
-	command := &Command{
-		Log:      log,
-		Runner:   cmdRunner,
-		SetupCfg: setupCfg,
-	}
+	svc := NewService(log, setupCfg, WithCfgLocation(cfgLocation))
 
 	// listen to kill messages
-	cmdRunner.HandleFunc("kill", func(cmsg CmdMessage) {
+	svc.Runner().HandleFunc("kill", func(cmsg CmdMessage) {
 		log.Error("GOT KILL")
 		os.Exit(1)
 	})
 
-	wpacfg := NewWpaCfg(log, cfgLocation)
-	wpacfg.StartAP()
+	svc.Start(context.Background())
 
-	time.Sleep(10 * time.Second)
-
-	command.StartWpaSupplicant()
-
-	// Scan
-	time.Sleep(5 * time.Second)
-	wpacfg.ScanNetworks()
-
-	command.StartDnsmasq()
+	select {}
+}
 
-	// TODO: check to see if we are stuck in a scanning state before
-	// if in a scanning state set a timeout before resetting
-	go func() {
-		for {
-			wpacfg.ScanNetworks()
-			time.Sleep(30 * time.Second)
+// cmdBuffer is the buffer of command output subscriptions.
+const cmdBuffer = 256
+
+// HandleFunc calls handler for all output of a command id, "*" for all
+// commands. Each handler runs in its own goroutine, when it falls behind
+// its oldest output is dropped rather than stalling the command output,
+// counted by txwifi_bus_dropped_total.
+func (c *CmdRunner) HandleFunc(cmdId string, handler func(cmdMessage CmdMessage)) *Subscription {
+	return c.Bus.SubscribeFunc(TopicCmd+cmdId, cmdBuffer, DeliverDropOldest, func(msg BusMessage) {
+		if cmsg, ok := msg.Payload.(CmdMessage); ok {
+			handler(cmsg)
 		}
-	}()
-
-	// staticFields for logger
-	staticFields := make(map[string]interface{})
+	})
+}
 
-	// command output loop (channel messages)
-	// loop and log
-	//
-	for {
-		out := <-messages // Block until we receive a message on the channel
+// stop kills a running command started by ProcessCmd and waits for it
+// to exit.
+func (c *CmdRunner) stop(id string) {
+	c.running.mu.Lock()
+	cmd, ok := c.Commands[id]
+	exited := c.running.exited[cmd]
+	c.running.mu.Unlock()
 
-		staticFields["cmd_id"] = out.Id
-		staticFields["cmd"] = out.Command
-		staticFields["is_error"] = out.Error
+	if !ok || cmd.Process == nil || exited == nil {
+		return
+	}
 
-		log.Info(staticFields, out.Message)
+	c.Log.Info("Stopping %s", id)
+	cmd.Process.Kill()
 
-		if handler, ok := cmdRunner.Handlers[out.Id]; ok {
-			handler(out)
-		}
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		c.Log.Error("%s did not exit within %s", id, stopTimeout)
 	}
 }
 
-// HandleFunc is a function that gets all channel messages for a command id
-func (c *CmdRunner) HandleFunc(cmdId string, handler func(cmdMessage CmdMessage)) {
-	c.Handlers[cmdId] = handler
-}
-
-// ProcessCmd processes an internal command.
-func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) {
+// ProcessCmd starts an internal command and publishes its output,
+// returning an error when it cannot be started.
+func (c *CmdRunner) ProcessCmd(id string, cmd *exec.Cmd) error {
 	c.Log.Debug("ProcessCmd got %s", id)
 
-	// add command to the commands map TODO close the readers
-	c.Commands[id] = cmd
-
 	cmdStdoutReader, err := cmd.StdoutPipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	cmdStderrReader, err := cmd.StderrPipe()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	stdOutScanner := bufio.NewScanner(cmdStdoutReader)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	c.running.mu.Lock()
+	c.Commands[id] = cmd
+	c.running.exited[cmd] = exited
+	c.running.mu.Unlock()
+
+	procs := c.state.procs
+	procs.started(id, cmd)
+
+	// reap the process once both outputs are closed
+	var outputs sync.WaitGroup
+	outputs.Add(2)
 	go func() {
-		for stdOutScanner.Scan() {
-			c.Messages <- CmdMessage{
-				Id:      id,
-				Command: cmd.Path,
-				Message: stdOutScanner.Text(),
-				Error:   false,
-				Cmd:     cmd,
-			}
+		outputs.Wait()
+		err := cmd.Wait()
+		procs.exited(id, cmd, err)
+
+		c.running.mu.Lock()
+		if c.Commands[id] == cmd {
+			delete(c.Commands, id)
 		}
+		delete(c.running.exited, cmd)
+		c.running.mu.Unlock()
+		close(exited)
 	}()
 
-	stdErrScanner := bufio.NewScanner(cmdStderrReader)
-	go func() {
-		for stdErrScanner.Scan() {
-			c.Messages <- CmdMessage{
-				Id:      id,
-				Command: cmd.Path,
-				Message: stdErrScanner.Text(),
-				Error:   true,
-				Cmd:     cmd,
-			}
+	go c.scanOutput(id, cmd, cmdStdoutReader, false, &outputs)
+	go c.scanOutput(id, cmd, cmdStderrReader, true, &outputs)
+
+	return nil
+}
+
+// scanOutput publishes each line of a command output as a CmdMessage, lines
+// recognised by ParseEvent carry the Event and are published on the
+// event bus.
+func (c *CmdRunner) scanOutput(id string, cmd *exec.Cmd, reader io.Reader, isError bool, outputs *sync.WaitGroup) {
+	defer outputs.Done()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		cmsg := CmdMessage{
+			Id:      id,
+			Command: cmd.Path,
+			Message: scanner.Text(),
+			Error:   isError,
+			Cmd:     cmd,
 		}
-	}()
 
-	err = cmd.Start()
+		if event, ok := ParseEvent(id, cmsg.Message); ok {
+			cmsg.Event = &event
+			c.Bus.PublishEvent(event)
+		}
 
-	if err != nil {
-		panic(err)
+		c.Bus.Publish(TopicCmd+id, cmsg)
 	}
 }
@@ -0,0 +1,79 @@
+package iotwifi
+
+import "fmt"
+
+// Logger is the leveled, structured logger of the package. Arguments
+// follow the bunyan convention: an optional map of fields or an error,
+// then a message or a printf format and its arguments, see LogArgs.
+type Logger interface {
+	Trace(args ...interface{})
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+
+	// Fatal logs at the fatal level, it does not exit.
+	Fatal(args ...interface{})
+
+	// Child returns a logger adding fields to every line.
+	Child(fields map[string]interface{}) Logger
+}
+
+// LogArgs splits the arguments of a Logger call into its fields and
+// message, for adapters to other loggers. An error is returned in the
+// "error" field.
+func LogArgs(args ...interface{}) (map[string]interface{}, string) {
+	fields := map[string]interface{}{}
+
+	if len(args) > 0 {
+		switch first := args[0].(type) {
+		case map[string]interface{}:
+			for key, value := range first {
+				fields[key] = value
+			}
+			args = args[1:]
+		case error:
+			fields["error"] = first.Error()
+			args = args[1:]
+		}
+	}
+
+	switch {
+	case len(args) == 0:
+		return fields, ""
+	case len(args) == 1:
+		return fields, fmt.Sprint(args[0])
+	}
+
+	if format, ok := args[0].(string); ok {
+		return fields, fmt.Sprintf(format, args[1:]...)
+	}
+
+	return fields, fmt.Sprint(args...)
+}
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+// NopLogger returns a Logger discarding everything, for tests and
+// programs without logging.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Trace(args ...interface{})                  {}
+func (nopLogger) Debug(args ...interface{})                  {}
+func (nopLogger) Info(args ...interface{})                   {}
+func (nopLogger) Warn(args ...interface{})                   {}
+func (nopLogger) Error(args ...interface{})                  {}
+func (nopLogger) Fatal(args ...interface{})                  {}
+func (nopLogger) Child(fields map[string]interface{}) Logger { return nopLogger{} }
+
+// orNop returns log, or a NopLogger when it is nil.
+func orNop(log Logger) Logger {
+	if log == nil {
+		return NopLogger()
+	}
+
+	return log
+}
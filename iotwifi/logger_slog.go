@@ -0,0 +1,65 @@
+//go:build go1.21
+// +build go1.21
+
+package iotwifi
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// Levels of Logger.Trace and Logger.Fatal beyond those of slog.
+const (
+	LevelTrace = slog.LevelDebug - 4
+	LevelFatal = slog.LevelError + 4
+)
+
+// slogLogger adapts a log/slog Logger.
+type slogLogger struct {
+	log *slog.Logger
+}
+
+// SlogLogger returns a Logger writing to a log/slog logger, fields
+// become attributes.
+func SlogLogger(log *slog.Logger) Logger {
+	return slogLogger{log: log}
+}
+
+// slogAttrs returns fields as attributes sorted by key.
+func slogAttrs(fields map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, slog.Any(key, fields[key]))
+	}
+
+	return attrs
+}
+
+// write logs the arguments of a Logger call at level.
+func (l slogLogger) write(level slog.Level, args []interface{}) {
+	ctx := context.Background()
+	if !l.log.Enabled(ctx, level) {
+		return
+	}
+
+	fields, msg := LogArgs(args...)
+	l.log.Log(ctx, level, msg, slogAttrs(fields)...)
+}
+
+func (l slogLogger) Trace(args ...interface{}) { l.write(LevelTrace, args) }
+func (l slogLogger) Debug(args ...interface{}) { l.write(slog.LevelDebug, args) }
+func (l slogLogger) Info(args ...interface{})  { l.write(slog.LevelInfo, args) }
+func (l slogLogger) Warn(args ...interface{})  { l.write(slog.LevelWarn, args) }
+func (l slogLogger) Error(args ...interface{}) { l.write(slog.LevelError, args) }
+func (l slogLogger) Fatal(args ...interface{}) { l.write(LevelFatal, args) }
+
+func (l slogLogger) Child(fields map[string]interface{}) Logger {
+	return slogLogger{log: l.log.With(slogAttrs(fields)...)}
+}
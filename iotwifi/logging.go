@@ -0,0 +1,288 @@
+package iotwifi
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Log output formats.
+const (
+	LogFormatJson = "json"
+	LogFormatText = "text"
+)
+
+// Log level names.
+const (
+	logLevelTrace = "trace"
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+	logLevelFatal = "fatal"
+)
+
+// logLevels maps level names to their numeric values.
+var logLevels = map[string]int{
+	logLevelTrace: 10,
+	logLevelDebug: 20,
+	logLevelInfo:  30,
+	logLevelWarn:  40,
+	logLevelError: 50,
+	logLevelFatal: 60,
+}
+
+// logLevelName returns the name of a numeric level.
+func logLevelName(level int) string {
+	for name, value := range logLevels {
+		if value == level {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("%d", level)
+}
+
+// parseLogLevel returns the numeric value of a level name.
+func parseLogLevel(level string) (int, error) {
+	value, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+
+	return value, nil
+}
+
+// LogLevels holds the global log level and the levels of sources, the
+// cmd_id field of child process output. Loggers returned by Logger
+// filter by them, so they can be changed at runtime whatever the
+// underlying Logger.
+type LogLevels struct {
+	mu      sync.Mutex
+	level   int
+	sources map[string]int
+}
+
+// NewLogLevels creates LogLevels from the levels of cfg.
+func NewLogLevels(cfg LogCfg) (*LogLevels, error) {
+	levels := &LogLevels{
+		level:   logLevels[logLevelInfo],
+		sources: make(map[string]int),
+	}
+
+	if cfg.Level != "" {
+		if err := levels.SetLevel("", cfg.Level); err != nil {
+			return nil, err
+		}
+	}
+
+	for source, level := range cfg.Sources {
+		if err := levels.SetLevel(source, level); err != nil {
+			return nil, err
+		}
+	}
+
+	return levels, nil
+}
+
+// SetLevel sets the level of a source, or the global level if source is
+// empty. An empty level removes a source level.
+func (l *LogLevels) SetLevel(source string, level string) error {
+	if source != "" && level == "" {
+		l.mu.Lock()
+		delete(l.sources, source)
+		l.mu.Unlock()
+		return nil
+	}
+
+	value, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if source == "" {
+		l.level = value
+		return nil
+	}
+	l.sources[source] = value
+
+	return nil
+}
+
+// Levels returns the global level under "" and the per-source levels.
+func (l *LogLevels) Levels() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	levels := map[string]string{"": logLevelName(l.level)}
+	for source, level := range l.sources {
+		levels[source] = logLevelName(level)
+	}
+
+	return levels
+}
+
+// enabled reports whether a line of source at level is logged.
+func (l *LogLevels) enabled(source string, level string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	threshold, ok := l.sources[source]
+	if !ok {
+		threshold = l.level
+	}
+
+	return logLevels[level] >= threshold
+}
+
+// Logger returns a Logger writing to log the lines enabled by the
+// levels. Set log itself to its most verbose level.
+func (l *LogLevels) Logger(log Logger) Logger {
+	return levelLogger{levels: l, log: log}
+}
+
+// levelLogger filters the lines of a Logger by LogLevels.
+type levelLogger struct {
+	levels *LogLevels
+	log    Logger
+	source string
+}
+
+// logSource returns the cmd_id field of fields, or "" if it has none.
+func logSource(fields map[string]interface{}) string {
+	source, _ := fields["cmd_id"].(string)
+	return source
+}
+
+// enabled reports whether a call at level with args is logged, the source
+// is the cmd_id field of the call or of the logger.
+func (l levelLogger) enabled(level string, args []interface{}) bool {
+	source := l.source
+	if len(args) > 0 {
+		if fields, ok := args[0].(map[string]interface{}); ok {
+			if s := logSource(fields); s != "" {
+				source = s
+			}
+		}
+	}
+
+	return l.levels.enabled(source, level)
+}
+
+func (l levelLogger) Trace(args ...interface{}) {
+	if l.enabled(logLevelTrace, args) {
+		l.log.Trace(args...)
+	}
+}
+
+func (l levelLogger) Debug(args ...interface{}) {
+	if l.enabled(logLevelDebug, args) {
+		l.log.Debug(args...)
+	}
+}
+
+func (l levelLogger) Info(args ...interface{}) {
+	if l.enabled(logLevelInfo, args) {
+		l.log.Info(args...)
+	}
+}
+
+func (l levelLogger) Warn(args ...interface{}) {
+	if l.enabled(logLevelWarn, args) {
+		l.log.Warn(args...)
+	}
+}
+
+func (l levelLogger) Error(args ...interface{}) {
+	if l.enabled(logLevelError, args) {
+		l.log.Error(args...)
+	}
+}
+
+func (l levelLogger) Fatal(args ...interface{}) {
+	if l.enabled(logLevelFatal, args) {
+		l.log.Fatal(args...)
+	}
+}
+
+func (l levelLogger) Child(fields map[string]interface{}) Logger {
+	child := levelLogger{levels: l.levels, log: l.log.Child(fields), source: l.source}
+	if s := logSource(fields); s != "" {
+		child.source = s
+	}
+
+	return child
+}
+
+// childErrorPrefixes are the prefixes of failures in the output of the
+// managed processes, after a leading tag such as "dnsmasq: ", "uap0: "
+// or "nl80211: ". Other lines mentioning errors are regular output.
+var childErrorPrefixes = map[string][]string{
+	"dnsmasq":        {"failed to ", "bad ", "cannot ", "unknown ", "error "},
+	"hostapd":        {"Could not ", "Failed to ", "Interface initialization failed", "Configuration file: ", "Line "},
+	"wpa_supplicant": {"Could not ", "Failed to ", "Line "},
+}
+
+// childLineLevel classifies a line of child process output. Failures are
+// errors, warnings warn, debug output of hostapd -d and wpa_supplicant -d
+// and dnsmasq query logging are debug, events and DHCP are info. Output
+// of other commands is an error on stderr.
+func childLineLevel(id string, line string, isError bool) string {
+	prefixes, known := childErrorPrefixes[id]
+	if !known {
+		if isError {
+			return logLevelError
+		}
+		return logLevelInfo
+	}
+
+	message := line
+	if i := strings.Index(line, ": "); i > 0 && !strings.ContainsAny(line[:i], " \t") {
+		message = line[i+2:]
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(message, prefix) {
+			return logLevelError
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(message), "warning") {
+		return logLevelWarn
+	}
+
+	switch id {
+	case "dnsmasq":
+		for _, chatty := range []string{"query[", "forwarded ", "reply ", "cached ", "config ", "/etc/hosts", "nxdomain"} {
+			if strings.Contains(line, chatty) {
+				return logLevelDebug
+			}
+		}
+		return logLevelInfo
+	}
+
+	if strings.Contains(line, "CTRL-EVENT-") || strings.Contains(line, "AP-") || strings.Contains(line, "WPA: Key negotiation completed") {
+		return logLevelInfo
+	}
+
+	return logLevelDebug
+}
+
+// logChildLine logs a line of child process output at its classified
+// level with the source in cmd_id.
+func logChildLine(log Logger, fields map[string]interface{}, id string, line string, isError bool) {
+	fields["cmd_id"] = id
+	fields["is_error"] = isError
+
+	switch childLineLevel(id, line, isError) {
+	case logLevelDebug:
+		log.Debug(fields, line)
+	case logLevelWarn:
+		log.Warn(fields, line)
+	case logLevelError:
+		log.Error(fields, line)
+	default:
+		log.Info(fields, line)
+	}
+}
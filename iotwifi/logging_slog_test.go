@@ -0,0 +1,45 @@
+//go:build go1.21
+// +build go1.21
+
+package iotwifi
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogLevelsFilterSlogLogger(t *testing.T) {
+	levels, err := NewLogLevels(LogCfg{Level: "info", Sources: map[string]string{"dnsmasq": "warn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	log := levels.Logger(SlogLogger(slog.New(
+		slog.NewTextHandler(&out, &slog.HandlerOptions{Level: LevelTrace}),
+	)))
+
+	log.Debug("debug dropped")
+	log.Info("info kept")
+	log.Info(map[string]interface{}{"cmd_id": "dnsmasq"}, "dnsmasq info dropped")
+	log.Warn(map[string]interface{}{"cmd_id": "dnsmasq"}, "dnsmasq warn kept")
+	log.Child(map[string]interface{}{"cmd_id": "dnsmasq"}).Info("dnsmasq child info dropped")
+
+	if err := levels.SetLevel("dnsmasq", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	log.Child(map[string]interface{}{"cmd_id": "dnsmasq"}).Debug("dnsmasq debug kept")
+	log.Debug("global debug dropped")
+
+	got := out.String()
+	for _, msg := range []string{"info kept", "dnsmasq warn kept", "dnsmasq debug kept"} {
+		if !strings.Contains(got, msg) {
+			t.Errorf("%q not logged:\n%s", msg, got)
+		}
+	}
+	if strings.Contains(got, "dropped") {
+		t.Errorf("filtered lines logged:\n%s", got)
+	}
+}
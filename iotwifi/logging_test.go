@@ -0,0 +1,36 @@
+package iotwifi
+
+import "testing"
+
+func TestChildLineLevel(t *testing.T) {
+	tests := []struct {
+		id      string
+		line    string
+		isError bool
+		want    string
+	}{
+		{"dnsmasq", "dnsmasq: failed to create listening socket for port 53: Address in use", true, logLevelError},
+		{"dnsmasq", "dnsmasq: bad dhcp-range at line 7 of /var/run/txwifi/dnsmasq.conf", true, logLevelError},
+		{"dnsmasq", "dnsmasq: warning: no upstream servers configured", true, logLevelWarn},
+		{"dnsmasq", "dnsmasq: query[A] error.example.com from 192.168.27.120", true, logLevelDebug},
+		{"dnsmasq", "dnsmasq: reply failed.example.com is NXDOMAIN", true, logLevelDebug},
+		{"dnsmasq", "dnsmasq-dhcp: DHCPACK(uap0) 192.168.27.120 5c:cf:7f:01:02:03 error-laptop", true, logLevelInfo},
+		{"hostapd", "Could not set channel for kernel driver", false, logLevelError},
+		{"hostapd", "nl80211: Could not configure driver mode", false, logLevelError},
+		{"hostapd", "Interface initialization failed", false, logLevelError},
+		{"hostapd", "uap0: AP-STA-CONNECTED 5c:cf:7f:01:02:03", false, logLevelInfo},
+		{"hostapd", "nl80211: send_and_recv->nl_recvmsgs failed: -22", false, logLevelDebug},
+		{"wpa_supplicant", "Failed to initialize driver interface", false, logLevelError},
+		{"wpa_supplicant", "wlan0: CTRL-EVENT-CONNECTED - Connection to 00:11:22:33:44:55 completed", false, logLevelInfo},
+		{"wpa_supplicant", "EAPOL: SUPP_PAE entering state FAILED", false, logLevelDebug},
+		{"wpa_supplicant", "wlan0: WPA: 4-Way Handshake failed - pre-shared key may be incorrect", false, logLevelDebug},
+		{"other", "something went wrong", true, logLevelError},
+		{"other", "error in the message only", false, logLevelInfo},
+	}
+
+	for _, tt := range tests {
+		if got := childLineLevel(tt.id, tt.line, tt.isError); got != tt.want {
+			t.Errorf("%s %q: got %s, want %s", tt.id, tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package iotwifi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsContentType is the content type of WriteMetrics output.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets in seconds for API and command
+// latencies.
+var DefaultBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// metric is a family of samples in the Prometheus text format.
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// metricsRegistry holds all metric families, written in name order.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+// registry is the registry used by NewCounter, NewGauge and NewHistogram.
+var registry = &metricsRegistry{metrics: make(map[string]metric)}
+
+// register adds a metric, replacing one with the same name.
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics[m.name()] = m
+}
+
+// WriteMetrics writes all registered metrics in the Prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer) error {
+	registry.mu.Lock()
+	names := make([]string, 0, len(registry.metrics))
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// metricVec holds the label values of a metric family.
+type metricVec struct {
+	mu     sync.Mutex
+	Name   string
+	Help   string
+	Labels []string
+}
+
+func (v *metricVec) name() string {
+	return v.Name
+}
+
+// key joins label values into a map key.
+func (v *metricVec) key(labelValues []string) string {
+	if len(labelValues) != len(v.Labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.Name, len(v.Labels), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelString renders {a="1",b="2"} for label values joined by key,
+// with extra appended after the family labels.
+func (v *metricVec) labelString(key string, extra ...string) string {
+	pairs := []string{}
+	if len(v.Labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, v.Labels[i]+"="+quoteLabel(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// header writes the HELP and TYPE lines.
+func (v *metricVec) header(w *bufio.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.Name, v.Help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.Name, typ)
+}
+
+// sortedKeys returns the keys of values in order.
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// formatFloat formats a sample value.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing metric.
+type Counter struct {
+	metricVec
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		metricVec: metricVec{Name: name, Help: help, Labels: labels},
+		values:    make(map[string]float64),
+	}
+	registry.register(c)
+
+	return c
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter with the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] += v
+}
+
+// Set sets a counter tracked elsewhere, such as process restarts.
+func (c *Counter) Set(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] = v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+// Gauge is a metric that can go up and down.
+type Gauge struct {
+	metricVec
+	values map[string]float64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		metricVec: metricVec{Name: name, Help: help, Labels: labels},
+		values:    make(map[string]float64),
+	}
+	registry.register(g)
+
+	return g
+}
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[key] = v
+}
+
+// Delete removes the gauge with the given label values.
+func (g *Gauge) Delete(labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.values, key)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.header(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.Name, g.labelString(key), formatFloat(g.values[key]))
+	}
+}
+
+// histogramValue is the state of one label combination of a histogram.
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	metricVec
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+// NewHistogram creates and registers a histogram with upper bounds
+// buckets, DefaultBuckets if nil.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+
+	h := &Histogram{
+		metricVec: metricVec{Name: name, Help: help, Labels: labels},
+		buckets:   buckets,
+		values:    make(map[string]*histogramValue),
+	}
+	registry.register(h)
+
+	return h
+}
+
+// Observe adds an observation with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h.header(w, "histogram")
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labelString(key, "le", formatFloat(upper)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labelString(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, h.labelString(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, h.labelString(key), hv.count)
+	}
+}
@@ -0,0 +1,91 @@
+package iotwifi
+
+import (
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProcState describes a managed child process.
+type ProcState struct {
+	Id         string    `json:"id"`
+	Pid        int       `json:"pid"`
+	Running    bool      `json:"running"`
+	Starts     int       `json:"starts"`
+	ExitStatus int       `json:"exit_status"`
+	StartedAt  time.Time `json:"started_at"`
+	ExitedAt   time.Time `json:"exited_at"`
+}
+
+// processTable tracks the child processes started by this process.
+type processTable struct {
+	mu    sync.Mutex
+	procs map[string]*ProcState
+}
+
+// started records a process start.
+func (p *processTable) started(id string, cmd *exec.Cmd) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.procs[id]
+	if !ok {
+		proc = &ProcState{Id: id}
+		p.procs[id] = proc
+	}
+
+	proc.Running = true
+	proc.Starts++
+	proc.ExitStatus = 0
+	proc.StartedAt = time.Now()
+	if cmd.Process != nil {
+		proc.Pid = cmd.Process.Pid
+	}
+}
+
+// exited records a process exit from its Wait error. Exits of a process
+// that has since been replaced are ignored.
+func (p *processTable) exited(id string, cmd *exec.Cmd, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.procs[id]
+	if !ok || cmd.Process == nil || proc.Pid != cmd.Process.Pid {
+		return
+	}
+
+	proc.Running = false
+	proc.ExitStatus = exitStatus(err)
+	proc.ExitedAt = time.Now()
+}
+
+// get returns the state of a process.
+func (p *processTable) get(id string) (ProcState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.procs[id]
+	if !ok {
+		return ProcState{Id: id}, false
+	}
+
+	return *proc, true
+}
+
+// list returns the state of every process, sorted by id.
+func (p *processTable) list() []ProcState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	states := make([]ProcState, 0, len(p.procs))
+	for _, proc := range p.procs {
+		states = append(states, *proc)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Id < states[j].Id
+	})
+
+	return states
+}
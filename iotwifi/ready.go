@@ -0,0 +1,208 @@
+package iotwifi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Boot phases reported by BootPhase.
+const (
+	BootStartingAp         = "starting-ap"
+	BootStartingSupplicant = "starting-supplicant"
+	BootStartingDnsmasq    = "starting-dnsmasq"
+	BootReady              = "ready"
+	BootDegraded           = "degraded"
+)
+
+const (
+	wpaCtrlDir = "/var/run/wpa_supplicant"
+
+	// readyInterval is the time between readiness checks.
+	readyInterval = 250 * time.Millisecond
+
+	defaultStartTimeout = 30 * time.Second
+	defaultStartRetries = 2
+)
+
+// bootStatus tracks startup progress of the Service.
+type bootStatus struct {
+	mu       sync.Mutex
+	phase    string
+	failures map[string]string
+}
+
+// set changes the boot phase.
+func (b *bootStatus) set(phase string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.phase = phase
+}
+
+// fail records a step that did not become ready.
+func (b *bootStatus) fail(step string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures[step] = err.Error()
+}
+
+// reset starts over, clearing failures.
+func (b *bootStatus) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.phase = BootStartingAp
+	b.failures = make(map[string]string)
+}
+
+// done sets the final phase, degraded if any step failed.
+func (b *bootStatus) done() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.phase = BootReady
+	if len(b.failures) > 0 {
+		b.phase = BootDegraded
+	}
+}
+
+// get returns the phase and a copy of the failures.
+func (b *bootStatus) get() (string, map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failures := make(map[string]string, len(b.failures))
+	for step, msg := range b.failures {
+		failures[step] = msg
+	}
+
+	return b.phase, failures
+}
+
+// parseStartTimeout parses a start_timeout setting.
+func parseStartTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return defaultStartTimeout, nil
+	}
+
+	return time.ParseDuration(timeout)
+}
+
+// startRetries returns the configured retries or the default.
+func startRetries(retries int) int {
+	if retries <= 0 {
+		return defaultStartRetries
+	}
+
+	return retries
+}
+
+// waitReady polls check until it returns nil or timeout passes.
+func waitReady(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not ready after %s: %s", timeout, err.Error())
+		}
+
+		time.Sleep(readyInterval)
+	}
+}
+
+// interfaceUp checks that a network interface exists and is
+// administratively up.
+func interfaceUp(iface string) error {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "flags"))
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", iface, err.Error())
+	}
+
+	flags, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 32)
+	if err != nil {
+		return fmt.Errorf("interface %s: %s", iface, err.Error())
+	}
+
+	if flags&uint64(net.FlagUp) == 0 {
+		return fmt.Errorf("interface %s is down", iface)
+	}
+
+	return nil
+}
+
+// apReady checks that the hostapd control socket answers PING and the AP
+// interface is up.
+func apReady() error {
+	reply, err := hostapdRequest("PING")
+	if err != nil {
+		return fmt.Errorf("hostapd: %s", err.Error())
+	}
+	if strings.TrimSpace(reply) != "PONG" {
+		return fmt.Errorf("hostapd: PING got %q", strings.TrimSpace(reply))
+	}
+
+	return interfaceUp("uap0")
+}
+
+// supplicantReady checks that the wpa_supplicant control socket exists,
+// answers PING and the station interface is up.
+func supplicantReady() error {
+	if _, err := os.Stat(filepath.Join(wpaCtrlDir, "wlan0")); err != nil {
+		return fmt.Errorf("wpa_supplicant: %s", err.Error())
+	}
+
+	pingOut, err := exec.Command("wpa_cli", "-i", "wlan0", "ping").Output()
+	if err != nil {
+		return fmt.Errorf("wpa_supplicant: %s", err.Error())
+	}
+	if strings.TrimSpace(string(pingOut)) != "PONG" {
+		return fmt.Errorf("wpa_supplicant: PING got %q", strings.TrimSpace(string(pingOut)))
+	}
+
+	return interfaceUp("wlan0")
+}
+
+// dnsmasqReady checks that dnsmasq accepts DNS connections on the AP
+// address.
+func dnsmasqReady(apIp string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(apIp, "53"), time.Second)
+	if err != nil {
+		return fmt.Errorf("dnsmasq: %s", err.Error())
+	}
+
+	return conn.Close()
+}
+
+// startStep runs start and waits for ready, retrying start up to retries
+// additional times. The failure is recorded against step in boot.
+func startStep(boot *bootStatus, step string, timeout time.Duration, retries int, start func() error, ready func() error) error {
+	var err error
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		err = start()
+		if err == nil {
+			err = waitReady(timeout, ready)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+
+	boot.fail(step, err)
+
+	return err
+}
@@ -0,0 +1,268 @@
+package iotwifi
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventCfgChanged is published when a changed configuration is applied.
+const EventCfgChanged = "config.changed"
+
+// EnvCfgWatch sets the polling interval of a configuration file, 0
+// disables watching.
+const EnvCfgWatch = "IOTWIFI_CFG_WATCH"
+
+// defaultCfgWatch is the polling interval of configuration files.
+const defaultCfgWatch = 2 * time.Second
+
+// ErrReloadUnavailable is returned by Service.Reload without a
+// configuration location.
+var ErrReloadUnavailable = errors.New("reload unavailable, no configuration location")
+
+// CfgReload reports what a configuration reload changed and how it was
+// applied.
+type CfgReload struct {
+	Changed         []string `json:"changed"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// Reloader applies configuration changes to the running processes and
+// publishes them on the bus of Wpa. Restart holds the start steps of
+// hostapd, wpa_supplicant and dnsmasq, Loaded receives every
+// configuration applied.
+type Reloader struct {
+	Log      Logger
+	Location string
+	SetupCfg *SharedCfg
+	Loaded   *SharedCfg
+	Wpa      *WpaCfg
+	Restart  map[string]func() error
+
+	mu sync.Mutex
+}
+
+// reloadInterval returns the interval Reloader.Watch checks a
+// configuration location at, 0 when it is not watched.
+func reloadInterval(cfgLocation string) time.Duration {
+	if isUrl(cfgLocation) {
+		remote, err := RemoteCfgFromEnv()
+		if err != nil {
+			return 0
+		}
+		return remote.Refresh
+	}
+
+	value := os.Getenv(EnvCfgWatch)
+	if value == "" {
+		return defaultCfgWatch
+	}
+	if value == "0" {
+		return 0
+	}
+
+	return connDuration(value, defaultCfgWatch)
+}
+
+// changedSections returns the json names of the sections that differ.
+func changedSections(old *SetupCfg, next *SetupCfg) []string {
+	changed := []string{}
+
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < o.NumField(); i++ {
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			changed = append(changed, jsonName(o.Type().Field(i)))
+		}
+	}
+
+	return changed
+}
+
+// mergeChanges returns the running configuration with the sections that
+// differ between the loaded and next configuration replaced by those of
+// next. AP credentials changed at runtime are kept unless next changes
+// them.
+func mergeChanges(running *SetupCfg, loaded *SetupCfg, next *SetupCfg) *SetupCfg {
+	merged := *running
+
+	m, l, n := reflect.ValueOf(&merged).Elem(), reflect.ValueOf(loaded).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < m.NumField(); i++ {
+		if !reflect.DeepEqual(l.Field(i).Interface(), n.Field(i).Interface()) {
+			m.Field(i).Set(n.Field(i))
+		}
+	}
+
+	if loaded.HostApdCfg.Ssid == next.HostApdCfg.Ssid {
+		merged.HostApdCfg.Ssid = running.HostApdCfg.Ssid
+	}
+	if loaded.HostApdCfg.WpaPassphrase == next.HostApdCfg.WpaPassphrase {
+		merged.HostApdCfg.WpaPassphrase = running.HostApdCfg.WpaPassphrase
+	}
+
+	return &merged
+}
+
+// onlyApCredentials reports whether two HostApdCfg differ in nothing but
+// the ssid and passphrase, which hostapd can change without a restart.
+func onlyApCredentials(old HostApdCfg, next HostApdCfg) bool {
+	for _, c := range []*HostApdCfg{&old, &next} {
+		c.Ssid = ""
+		c.WpaPassphrase = ""
+		c.PassphraseSecret = ""
+	}
+
+	return old == next
+}
+
+// Reload loads and validates the configuration, then applies it.
+func (r *Reloader) Reload(reason string) (CfgReload, error) {
+	next, err := loadCfg(r.Location, r.Wpa.st().remote)
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		return CfgReload{}, err
+	}
+
+	return r.Apply(next, reason)
+}
+
+// Apply applies the sections next changes from the loaded configuration
+// to the running one, see mergeChanges: the AP ssid and passphrase
+// through the hostapd control interface, other AP settings by restarting
+// hostapd, and dnsmasq and wpa_supplicant are restarted only when their
+// sections changed. Log, connection manager and reset settings take
+// effect on the next start.
+func (r *Reloader) Apply(next *SetupCfg, reason string) (CfgReload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.SetupCfg.Load()
+	loaded := old
+	if r.Loaded != nil {
+		loaded = r.Loaded.Load()
+		r.Loaded.Store(next)
+	}
+
+	result := CfgReload{
+		Changed:         changedSections(loaded, next),
+		Applied:         []string{},
+		RestartRequired: []string{},
+	}
+	if len(result.Changed) == 0 {
+		return result, nil
+	}
+
+	r.Log.Info(map[string]interface{}{"reason": reason, "changed": result.Changed}, "Reloading config")
+
+	next = mergeChanges(old, loaded, next)
+	r.SetupCfg.Store(next)
+
+	restart := map[string]bool{}
+	for _, section := range result.Changed {
+		switch section {
+		case "host_apd_cfg":
+			if !onlyApCredentials(old.HostApdCfg, next.HostApdCfg) {
+				restart["hostapd"] = true
+				// dnsmasq listens on the AP address and subnet
+				restart["dnsmasq"] = restart["dnsmasq"] || old.HostApdCfg.Ip != next.HostApdCfg.Ip ||
+					old.HostApdCfg.Netmask != next.HostApdCfg.Netmask
+				continue
+			}
+
+			ssid, passphrase := "", ""
+			if old.HostApdCfg.Ssid != next.HostApdCfg.Ssid {
+				ssid = next.HostApdCfg.Ssid
+			}
+			if old.HostApdCfg.WpaPassphrase != next.HostApdCfg.WpaPassphrase {
+				passphrase = next.HostApdCfg.WpaPassphrase
+			}
+			if ssid == "" && passphrase == "" {
+				// a new passphrase_secret deriving the same passphrase
+				continue
+			}
+			if err := r.Wpa.SetApCredentials(ssid, passphrase); err != nil {
+				r.Log.Error("Could not reconfigure hostapd, restarting it: %s", err.Error())
+				restart["hostapd"] = true
+				continue
+			}
+			result.Applied = append(result.Applied, "hostapd_credentials")
+		case "dnsmasq_cfg":
+			restart["dnsmasq"] = true
+		case "wpa_supplicant_cfg":
+			restart["wpa_supplicant"] = true
+		default:
+			result.RestartRequired = append(result.RestartRequired, section)
+		}
+	}
+
+	var first error
+	for _, step := range []string{"hostapd", "wpa_supplicant", "dnsmasq"} {
+		if !restart[step] {
+			continue
+		}
+		if err := r.Restart[step](); err != nil {
+			r.Log.Error("Could not restart %s: %s", step, err.Error())
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		result.Applied = append(result.Applied, step+"_restart")
+	}
+
+	r.Wpa.st().events.PublishEvent(Event{
+		Type:   EventCfgChanged,
+		Source: "txwifi",
+		Time:   time.Now(),
+		Fields: map[string]string{
+			"reason":  reason,
+			"changed": strings.Join(result.Changed, ","),
+			"applied": strings.Join(result.Applied, ","),
+		},
+	})
+
+	return result, first
+}
+
+// Watch reloads the configuration until stop is closed: files when
+// their modification time or size changes, urls every interval.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	reason := "refresh"
+	var modTime time.Time
+	var size int64
+
+	if !isUrl(r.Location) {
+		reason = "file"
+		if fi, err := os.Stat(r.Location); err == nil {
+			modTime, size = fi.ModTime(), fi.Size()
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if reason == "file" {
+			fi, err := os.Stat(r.Location)
+			if err != nil || (fi.ModTime().Equal(modTime) && fi.Size() == size) {
+				continue
+			}
+			modTime, size = fi.ModTime(), fi.Size()
+		}
+
+		if _, err := r.Reload(reason); err != nil {
+			r.Log.Error("Could not reload config %s: %s", r.Location, err.Error())
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package iotwifi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReloadKeepsRuntimeApCredentials(t *testing.T) {
+	loaded := &SetupCfg{
+		HostApdCfg: HostApdCfg{Ssid: "loaded", WpaPassphrase: "loadedpass", Channel: "6", Ip: "192.168.27.1"},
+		DnsmasqCfg: DnsmasqCfg{DhcpRange: "192.168.27.100,192.168.27.150"},
+	}
+
+	// PUT /ap/config changed the credentials of the running configuration
+	running := *loaded
+	running.HostApdCfg.Ssid = "runtime"
+	running.HostApdCfg.WpaPassphrase = "runtimepass"
+
+	tests := []struct {
+		name          string
+		change        func(c *SetupCfg)
+		changed       []string
+		restarts      []string
+		wantApCfg     HostApdCfg
+		wantDhcpRange string
+	}{
+		{
+			name:      "unchanged",
+			change:    func(c *SetupCfg) {},
+			changed:   []string{},
+			wantApCfg: running.HostApdCfg,
+		},
+		{
+			name:          "other section",
+			change:        func(c *SetupCfg) { c.DnsmasqCfg.DhcpRange = "192.168.27.10,192.168.27.20" },
+			changed:       []string{"dnsmasq_cfg"},
+			restarts:      []string{"dnsmasq"},
+			wantApCfg:     running.HostApdCfg,
+			wantDhcpRange: "192.168.27.10,192.168.27.20",
+		},
+		{
+			name:      "ap channel",
+			change:    func(c *SetupCfg) { c.HostApdCfg.Channel = "11" },
+			changed:   []string{"host_apd_cfg"},
+			restarts:  []string{"hostapd"},
+			wantApCfg: HostApdCfg{Ssid: "runtime", WpaPassphrase: "runtimepass", Channel: "11", Ip: "192.168.27.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := *loaded
+			tt.change(&next)
+
+			restarted := []string{}
+			restart := func(step string) func() error {
+				return func() error {
+					restarted = append(restarted, step)
+					return nil
+				}
+			}
+
+			r := &Reloader{
+				Log:      NopLogger(),
+				SetupCfg: NewSharedCfg(&running),
+				Loaded:   NewSharedCfg(loaded),
+				Wpa:      &WpaCfg{Log: NopLogger()},
+				Restart: map[string]func() error{
+					"hostapd":        restart("hostapd"),
+					"wpa_supplicant": restart("wpa_supplicant"),
+					"dnsmasq":        restart("dnsmasq"),
+				},
+			}
+
+			result, err := r.Apply(&next, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Changed, tt.changed) {
+				t.Errorf("changed %v, want %v", result.Changed, tt.changed)
+			}
+			if len(tt.restarts) > 0 && !reflect.DeepEqual(restarted, tt.restarts) {
+				t.Errorf("restarted %v, want %v", restarted, tt.restarts)
+			}
+			if len(tt.restarts) == 0 && len(restarted) > 0 {
+				t.Errorf("restarted %v", restarted)
+			}
+
+			got := r.SetupCfg.Load()
+			if got.HostApdCfg != tt.wantApCfg {
+				t.Errorf("host_apd_cfg %+v, want %+v", got.HostApdCfg, tt.wantApCfg)
+			}
+			if tt.wantDhcpRange != "" && got.DnsmasqCfg.DhcpRange != tt.wantDhcpRange {
+				t.Errorf("dhcp_range %s, want %s", got.DnsmasqCfg.DhcpRange, tt.wantDhcpRange)
+			}
+			if r.Loaded.Load() != &next {
+				t.Errorf("loaded configuration not replaced")
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package iotwifi
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring remote configuration urls.
+const (
+	EnvCfgToken    = "IOTWIFI_CFG_TOKEN"    // bearer token
+	EnvCfgUser     = "IOTWIFI_CFG_USER"     // basic auth user
+	EnvCfgPassword = "IOTWIFI_CFG_PASSWORD" // basic auth password
+	EnvCfgCa       = "IOTWIFI_CFG_CA"       // PEM file of the only trusted CAs
+	EnvCfgTimeout  = "IOTWIFI_CFG_TIMEOUT"  // 10s
+	EnvCfgCache    = "IOTWIFI_CFG_CACHE"    // /var/cache/txwifi/cfg
+	EnvCfgSha256   = "IOTWIFI_CFG_SHA256"   // expected hex checksum
+	EnvCfgPubKey   = "IOTWIFI_CFG_PUBKEY"   // base64 ed25519 public key
+	EnvCfgRefresh  = "IOTWIFI_CFG_REFRESH"  // 5m
+)
+
+const (
+	defaultCfgTimeout = 10 * time.Second
+	defaultCfgCache   = "/var/cache/txwifi/cfg"
+
+	// signatureHeader carries the base64 ed25519 signature of the body,
+	// without it the signature is fetched from the url with ".sig"
+	signatureHeader = "X-Signature"
+
+	// maxCfgSize limits configuration downloads.
+	maxCfgSize = 1 << 20
+)
+
+// ErrCfgVerify is returned when a configuration fails verification.
+var ErrCfgVerify = errors.New("configuration verification failed")
+
+// RemoteCfg configures fetching the configuration from a url.
+type RemoteCfg struct {
+	Token     string
+	Username  string
+	Password  string
+	CaFile    string
+	Timeout   time.Duration
+	CacheFile string
+	Sha256    string
+	PublicKey ed25519.PublicKey
+	Refresh   time.Duration
+}
+
+// RemoteCfgStatus reports the last fetch of a remote configuration.
+type RemoteCfgStatus struct {
+	Url       string    `json:"url"`
+	Etag      string    `json:"etag,omitempty"`
+	Fetched   time.Time `json:"fetched"`
+	FromCache bool      `json:"from_cache"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// remoteStatus holds the status of the last remote fetch of a Service.
+type remoteStatus struct {
+	mu sync.Mutex
+	s  *RemoteCfgStatus
+}
+
+// get returns the status, false before a remote fetch.
+func (r *remoteStatus) get() (RemoteCfgStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.s == nil {
+		return RemoteCfgStatus{}, false
+	}
+
+	return *r.s, true
+}
+
+// set records the status of a remote fetch, nothing on a nil r.
+func (r *remoteStatus) set(status *RemoteCfgStatus) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.s = status
+}
+
+// RemoteCfgFromEnv reads the remote configuration settings from the
+// IOTWIFI_CFG_* environment variables.
+func RemoteCfgFromEnv() (RemoteCfg, error) {
+	rc := RemoteCfg{
+		Token:     os.Getenv(EnvCfgToken),
+		Username:  os.Getenv(EnvCfgUser),
+		Password:  os.Getenv(EnvCfgPassword),
+		CaFile:    os.Getenv(EnvCfgCa),
+		Timeout:   defaultCfgTimeout,
+		CacheFile: defaultCfgCache,
+		Sha256:    strings.ToLower(strings.TrimSpace(os.Getenv(EnvCfgSha256))),
+	}
+
+	if cache, ok := os.LookupEnv(EnvCfgCache); ok {
+		rc.CacheFile = cache
+	}
+
+	for env, d := range map[string]*time.Duration{EnvCfgTimeout: &rc.Timeout, EnvCfgRefresh: &rc.Refresh} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return rc, fmt.Errorf("%s: %q is not a positive duration such as 30s", env, value)
+		}
+		*d = parsed
+	}
+
+	if key := os.Getenv(EnvCfgPubKey); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return rc, fmt.Errorf("%s: not a base64 ed25519 public key", EnvCfgPubKey)
+		}
+		rc.PublicKey = decoded
+	}
+
+	if rc.Sha256 != "" {
+		if b, err := hex.DecodeString(rc.Sha256); err != nil || len(b) != sha256.Size {
+			return rc, fmt.Errorf("%s: not a hex sha256 checksum", EnvCfgSha256)
+		}
+	}
+
+	return rc, nil
+}
+
+// client returns an http.Client with the timeout and pinned CAs.
+func (rc RemoteCfg) client() (*http.Client, error) {
+	client := &http.Client{Timeout: rc.Timeout}
+
+	if rc.CaFile != "" {
+		pem, err := ioutil.ReadFile(rc.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", rc.CaFile)
+		}
+		client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+
+	return client, nil
+}
+
+// get requests url with the configured authentication.
+func (rc RemoteCfg) get(client *http.Client, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	switch {
+	case rc.Token != "":
+		req.Header.Set("Authorization", "Bearer "+rc.Token)
+	case rc.Username != "":
+		req.SetBasicAuth(rc.Username, rc.Password)
+	}
+
+	return client.Do(req)
+}
+
+// cachedCfg is the metadata of a cached configuration.
+type cachedCfg struct {
+	Url          string `json:"url"`
+	Etag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	ContentType  string `json:"content_type"`
+	Signature    string `json:"signature"`
+}
+
+// readCache returns the cached configuration of url.
+func (rc RemoteCfg) readCache(url string) ([]byte, cachedCfg, error) {
+	meta := cachedCfg{}
+
+	if rc.CacheFile == "" {
+		return nil, meta, errors.New("no cache configured")
+	}
+
+	metaData, err := ioutil.ReadFile(rc.CacheFile + ".json")
+	if err != nil {
+		return nil, meta, err
+	}
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return nil, meta, err
+	}
+	if meta.Url != url {
+		return nil, meta, fmt.Errorf("cache is of %s", meta.Url)
+	}
+
+	data, err := ioutil.ReadFile(rc.CacheFile)
+
+	return data, meta, err
+}
+
+// writeCache stores a verified configuration.
+func (rc RemoteCfg) writeCache(data []byte, meta cachedCfg) error {
+	if rc.CacheFile == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rc.CacheFile), 0700); err != nil {
+		return err
+	}
+
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// write the body first, a stale .json only costs a full fetch
+	if err := writeFileAtomic(rc.CacheFile, data, 0600); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(rc.CacheFile+".json", metaData, 0600)
+}
+
+// writeFileAtomic replaces a file by renaming a temporary file over it.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// verify checks the checksum and signature of a configuration.
+func (rc RemoteCfg) verify(data []byte, signature string) error {
+	if rc.Sha256 != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != rc.Sha256 {
+			return fmt.Errorf("%s: sha256 does not match %s", ErrCfgVerify.Error(), EnvCfgSha256)
+		}
+	}
+
+	if rc.PublicKey != nil {
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+		if err != nil || !ed25519.Verify(rc.PublicKey, data, sig) {
+			return fmt.Errorf("%s: invalid signature", ErrCfgVerify.Error())
+		}
+	}
+
+	return nil
+}
+
+// signature returns the signature of a response, from its header or
+// the url with ".sig".
+func (rc RemoteCfg) signature(client *http.Client, url string, res *http.Response) (string, error) {
+	if rc.PublicKey == nil {
+		return "", nil
+	}
+	if sig := res.Header.Get(signatureHeader); sig != "" {
+		return sig, nil
+	}
+
+	sigRes, err := rc.get(client, url+".sig", nil)
+	if err != nil {
+		return "", err
+	}
+	defer sigRes.Body.Close()
+
+	if sigRes.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s.sig: %s", url, sigRes.Status)
+	}
+
+	sig, err := ioutil.ReadAll(io.LimitReader(sigRes.Body, 1024))
+
+	return string(sig), err
+}
+
+// fetch downloads the configuration at url and passes it to decode.
+// Responses are revalidated with ETag and If-Modified-Since against the
+// cache, which is used when the url is unreachable, returns an error
+// status or a configuration that fails verification or decode. The
+// status of the fetch is returned with any error.
+func (rc RemoteCfg) fetch(url string, decode func(data []byte, contentType string) error) (*RemoteCfgStatus, error) {
+	status := &RemoteCfgStatus{Url: url, Fetched: time.Now()}
+
+	cached, meta, cacheErr := rc.readCache(url)
+
+	fromCache := func(cause error) error {
+		status.Error = cause.Error()
+		if cacheErr != nil {
+			return cause
+		}
+		if err := rc.verify(cached, meta.Signature); err != nil {
+			return fmt.Errorf("%s, cache: %s", cause.Error(), err.Error())
+		}
+		if err := decode(cached, meta.ContentType); err != nil {
+			return fmt.Errorf("%s, cache: %s", cause.Error(), err.Error())
+		}
+		status.FromCache = true
+		status.Etag = meta.Etag
+		return nil
+	}
+
+	client, err := rc.client()
+	if err != nil {
+		return status, fromCache(err)
+	}
+	// refreshes are minutes apart, don't keep connections to the server
+	defer client.CloseIdleConnections()
+
+	header := http.Header{}
+	if cacheErr == nil {
+		if meta.Etag != "" {
+			header.Set("If-None-Match", meta.Etag)
+		}
+		if meta.LastModified != "" {
+			header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	res, err := rc.get(client, url, header)
+	if err != nil {
+		return status, fromCache(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && cacheErr == nil {
+		if err := fromCache(errors.New("not modified")); err != nil {
+			return status, err
+		}
+		status.Error = ""
+		return status, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return status, fromCache(fmt.Errorf("GET %s: %s", url, res.Status))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCfgSize+1))
+	if err != nil {
+		return status, fromCache(err)
+	}
+	if len(data) > maxCfgSize {
+		return status, fromCache(fmt.Errorf("GET %s: larger than %d bytes", url, maxCfgSize))
+	}
+
+	sig, err := rc.signature(client, url, res)
+	if err != nil {
+		return status, fromCache(err)
+	}
+	if err := rc.verify(data, sig); err != nil {
+		return status, fromCache(err)
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if err := decode(data, contentType); err != nil {
+		return status, fromCache(err)
+	}
+
+	status.Etag = res.Header.Get("ETag")
+
+	// only configurations that decode replace the cache
+	if !bytes.Equal(data, cached) || meta.Etag != status.Etag {
+		err := rc.writeCache(data, cachedCfg{
+			Url:          url,
+			Etag:         status.Etag,
+			LastModified: res.Header.Get("Last-Modified"),
+			ContentType:  contentType,
+			Signature:    sig,
+		})
+		if err != nil {
+			status.Error = "cache: " + err.Error()
+		}
+	}
+
+	return status, nil
+}
@@ -0,0 +1,287 @@
+package iotwifi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testCfgBody = `{"host_apd_cfg": {"ssid": "remote"}}`
+
+// testRemoteCfg returns a RemoteCfg caching in a temporary directory.
+func testRemoteCfg(t *testing.T) RemoteCfg {
+	dir, err := ioutil.TempDir("", "remotecfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return RemoteCfg{Timeout: 5 * time.Second, CacheFile: filepath.Join(dir, "cfg")}
+}
+
+// fetchText fetches url with rc and returns the decoded body.
+func fetchText(rc RemoteCfg, url string) (string, *RemoteCfgStatus, error) {
+	var got string
+	status, err := rc.fetch(url, func(data []byte, contentType string) error {
+		got = string(data)
+		return nil
+	})
+
+	return got, status, err
+}
+
+// serveCfg serves body with an ETag and Last-Modified, answering
+// matching revalidations with 304 and recording the request headers.
+func serveCfg(body string, headers chan<- http.Header) *httptest.Server {
+	const etag = `"v1"`
+	const modified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if headers != nil {
+			headers <- r.Header
+		}
+		if r.Header.Get("If-None-Match") == etag && r.Header.Get("If-Modified-Since") == modified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestRemoteCfgRevalidates(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	server := serveCfg(testCfgBody, headers)
+	defer server.Close()
+
+	rc := testRemoteCfg(t)
+
+	got, status, err := fetchText(rc, server.URL)
+	if err != nil {
+		t.Fatalf("first fetch: %s", err)
+	}
+	if got != testCfgBody || status.FromCache || status.Etag != `"v1"` {
+		t.Fatalf("first fetch: got %q, status %+v", got, status)
+	}
+	if h := <-headers; h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Errorf("first fetch revalidated: %v", h)
+	}
+
+	got, status, err = fetchText(rc, server.URL)
+	if err != nil {
+		t.Fatalf("second fetch: %s", err)
+	}
+	h := <-headers
+	if h.Get("If-None-Match") != `"v1"` || h.Get("If-Modified-Since") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("second fetch did not revalidate: %v", h)
+	}
+	if got != testCfgBody || !status.FromCache || status.Error != "" || status.Etag != `"v1"` {
+		t.Errorf("not modified: got %q, status %+v", got, status)
+	}
+}
+
+func TestRemoteCfgAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		rc   RemoteCfg
+		want string
+	}{
+		{name: "none", want: ""},
+		{name: "token", rc: RemoteCfg{Token: "secret"}, want: "Bearer secret"},
+		{name: "basic", rc: RemoteCfg{Username: "user", Password: "pass"}, want: "Basic dXNlcjpwYXNz"},
+		{name: "token wins", rc: RemoteCfg{Token: "secret", Username: "user"}, want: "Bearer secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(chan http.Header, 1)
+			server := serveCfg(testCfgBody, headers)
+			defer server.Close()
+
+			rc := tt.rc
+			rc.Timeout = 5 * time.Second
+			if _, _, err := fetchText(rc, server.URL); err != nil {
+				t.Fatal(err)
+			}
+			if got := (<-headers).Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteCfgSizeLimit(t *testing.T) {
+	server := serveCfg(strings.Repeat(" ", maxCfgSize+1), nil)
+	defer server.Close()
+
+	rc := testRemoteCfg(t)
+	_, _, err := fetchText(rc, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("got error %v, want the size limit", err)
+	}
+	if _, err := os.Stat(rc.CacheFile); !os.IsNotExist(err) {
+		t.Errorf("oversized configuration was cached")
+	}
+}
+
+func TestRemoteCfgVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(body string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(body)))
+	}
+	sum := sha256.Sum256([]byte(testCfgBody))
+
+	tests := []struct {
+		name      string
+		rc        RemoteCfg
+		header    string // X-Signature
+		sigFile   string // served at url + ".sig", "-" is not found
+		verifyErr bool
+	}{
+		{name: "sha256", rc: RemoteCfg{Sha256: hex.EncodeToString(sum[:])}},
+		{name: "sha256 mismatch", rc: RemoteCfg{Sha256: strings.Repeat("0", 64)}, verifyErr: true},
+		{name: "signature header", rc: RemoteCfg{PublicKey: public}, header: sign(testCfgBody)},
+		{name: "signature file", rc: RemoteCfg{PublicKey: public}, sigFile: sign(testCfgBody)},
+		{name: "signature mismatch", rc: RemoteCfg{PublicKey: public}, header: sign("other"), verifyErr: true},
+		{name: "signature missing", rc: RemoteCfg{PublicKey: public}, sigFile: "-", verifyErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, ".sig") {
+					if tt.sigFile == "-" {
+						http.NotFound(w, r)
+						return
+					}
+					w.Write([]byte(tt.sigFile))
+					return
+				}
+				if tt.header != "" {
+					w.Header().Set(signatureHeader, tt.header)
+				}
+				w.Write([]byte(testCfgBody))
+			}))
+			defer server.Close()
+
+			rc := tt.rc
+			rc.Timeout = 5 * time.Second
+			rc.CacheFile = testRemoteCfg(t).CacheFile
+
+			got, _, err := fetchText(rc, server.URL+"/cfg.json")
+			if tt.verifyErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				if tt.sigFile != "-" && !strings.Contains(err.Error(), ErrCfgVerify.Error()) {
+					t.Errorf("got error %v, want %v", err, ErrCfgVerify)
+				}
+				if _, err := os.Stat(rc.CacheFile); !os.IsNotExist(err) {
+					t.Errorf("unverified configuration was cached")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != testCfgBody {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestRemoteCfgCacheFallback(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(testCfgBody))
+	}))
+	url := server.URL
+
+	rc := testRemoteCfg(t)
+	if _, _, err := fetchText(rc, url); err != nil {
+		t.Fatalf("first fetch: %s", err)
+	}
+
+	// an error status falls back to the cache
+	atomic.StoreInt32(&failing, 1)
+	got, status, err := fetchText(rc, url)
+	if err != nil {
+		t.Fatalf("error status: %s", err)
+	}
+	if got != testCfgBody || !status.FromCache || !strings.Contains(status.Error, "500") {
+		t.Errorf("error status: got %q, status %+v", got, status)
+	}
+
+	// so does an unreachable url
+	server.Close()
+	got, status, err = fetchText(rc, url)
+	if err != nil {
+		t.Fatalf("unreachable: %s", err)
+	}
+	if got != testCfgBody || !status.FromCache || status.Error == "" {
+		t.Errorf("unreachable: got %q, status %+v", got, status)
+	}
+
+	// without a cache the error is returned
+	rc.CacheFile = ""
+	if _, status, err := fetchText(rc, url); err == nil || status.FromCache {
+		t.Errorf("without a cache: got error %v, status %+v", err, status)
+	}
+}
+
+func TestRemoteCfgPinnedCaClosesConnections(t *testing.T) {
+	closed := make(chan struct{}, 4)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testCfgBody))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	rc := testRemoteCfg(t)
+	rc.CaFile = filepath.Join(filepath.Dir(rc.CacheFile), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(rc.CaFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := fetchText(rc, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testCfgBody {
+		t.Errorf("got %q", got)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection kept open after the fetch")
+	}
+}
@@ -0,0 +1,340 @@
+package iotwifi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reset events published on the event bus.
+const (
+	EventResetStarted = "reset.started"
+	EventResetDone    = "reset.done"
+)
+
+const (
+	defaultResetCertDir  = "/etc/txwifi/certs"
+	defaultResetStateDir = "/var/lib/txwifi"
+	defaultResetGpioHold = 5 * time.Second
+
+	// triggerInterval is the polling interval of reset triggers.
+	triggerInterval = 500 * time.Millisecond
+
+	gpioDir = "/sys/class/gpio"
+)
+
+// ErrResetInProgress is returned when a reset is already running.
+var ErrResetInProgress = errors.New("reset in progress")
+
+// networkBlockR matches network={...} blocks of wpa_supplicant.conf.
+var networkBlockR = regexp.MustCompile(`(?s)\n?[ \t]*network\s*=\s*\{.*?\n[ \t]*\}[ \t]*`)
+
+// ResetTrigger fires a factory reset, such as a button or a file.
+type ResetTrigger interface {
+	// Watch calls fire on each trigger until stop is closed.
+	Watch(stop <-chan struct{}, fire func())
+}
+
+// FileTrigger fires when Path exists and removes it. A file that cannot
+// be removed, such as on a read-only /boot, fires once until it is gone.
+type FileTrigger struct {
+	Path     string
+	Interval time.Duration
+	Log      Logger
+}
+
+// Watch polls for the file.
+func (t *FileTrigger) Watch(stop <-chan struct{}, fire func()) {
+	log := orNop(t.Log)
+
+	interval := t.Interval
+	if interval <= 0 {
+		interval = triggerInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	fired := false
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := os.Stat(t.Path); err != nil {
+			fired = false
+			continue
+		}
+		if fired {
+			continue
+		}
+
+		// remove first so a reset that restarts this process does not
+		// fire again
+		if err := os.Remove(t.Path); err != nil {
+			log.Error("Could not remove reset trigger %s, it fires again once removed: %s", t.Path, err.Error())
+			fired = true
+		}
+		fire()
+	}
+}
+
+// GpioTrigger fires when a button on a sysfs GPIO pin is held for Hold.
+// Buttons pull the pin low unless ActiveHigh is set. A pin that cannot
+// be exported is logged to Log and not watched.
+type GpioTrigger struct {
+	Pin        string
+	Hold       time.Duration
+	ActiveHigh bool
+	Interval   time.Duration
+	Log        Logger
+}
+
+// export makes the pin available as an input.
+func (t *GpioTrigger) export() error {
+	pinDir := filepath.Join(gpioDir, "gpio"+t.Pin)
+
+	if _, err := os.Stat(pinDir); os.IsNotExist(err) {
+		err := ioutil.WriteFile(filepath.Join(gpioDir, "export"), []byte(t.Pin), 0200)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(filepath.Join(pinDir, "direction"), []byte("in"), 0644)
+}
+
+// pressed reads the pin.
+func (t *GpioTrigger) pressed() (bool, error) {
+	value, err := ioutil.ReadFile(filepath.Join(gpioDir, "gpio"+t.Pin, "value"))
+	if err != nil {
+		return false, err
+	}
+
+	active := "0"
+	if t.ActiveHigh {
+		active = "1"
+	}
+
+	return strings.TrimSpace(string(value)) == active, nil
+}
+
+// Watch polls the pin, firing once per long press.
+func (t *GpioTrigger) Watch(stop <-chan struct{}, fire func()) {
+	if err := t.export(); err != nil {
+		orNop(t.Log).Error("Could not export reset GPIO pin %s, the reset button is disabled: %s", t.Pin, err.Error())
+		return
+	}
+
+	interval := t.Interval
+	if interval <= 0 {
+		interval = triggerInterval
+	}
+	hold := t.Hold
+	if hold <= 0 {
+		hold = defaultResetGpioHold
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var since time.Time
+	fired := false
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		pressed, err := t.pressed()
+		if err != nil || !pressed {
+			since = time.Time{}
+			fired = false
+			continue
+		}
+
+		if since.IsZero() {
+			since = time.Now()
+		}
+		if !fired && time.Since(since) >= hold {
+			fired = true
+			fire()
+		}
+	}
+}
+
+// Resetter wipes the wifi state and restarts the managed processes,
+// those of Runner and the AP, DHCP and connection states of its Service.
+// Loaded is the configuration as loaded, without AP credentials changed
+// at runtime.
+type Resetter struct {
+	Log      Logger
+	SetupCfg *SharedCfg
+	Loaded   *SharedCfg
+	Runner   CmdRunner
+	Restart  func()
+
+	mu      sync.Mutex
+	running bool
+}
+
+// Reset stops the managed processes, removes all saved networks from
+// wpa_supplicant.conf, removes stored certificates, service state and
+// DHCP leases, then restarts the processes in the background with the
+// HostApdCfg of the loaded configuration.
+func (r *Resetter) Reset(reason string) error {
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return ErrResetInProgress
+	}
+	r.running = true
+	r.mu.Unlock()
+
+	st := r.Runner.state
+
+	r.Log.Info(map[string]interface{}{"reason": reason}, "Factory reset")
+	st.events.PublishEvent(Event{
+		Type:   EventResetStarted,
+		Source: "txwifi",
+		Time:   time.Now(),
+		Fields: map[string]string{"reason": reason},
+	})
+
+	st.ap.stop()
+	r.Runner.stop("wpa_supplicant")
+	r.Runner.stop("dnsmasq")
+
+	err := r.wipe()
+
+	st.dhcp.reset()
+	st.conn.update(func(s *ConnStatus) {
+		*s = ConnStatus{State: ConnStateIdle}
+	})
+
+	if r.Loaded != nil {
+		hostApdCfg := r.Loaded.Load().HostApdCfg
+		r.SetupCfg.Update(func(c *SetupCfg) {
+			c.HostApdCfg = hostApdCfg
+		})
+	}
+
+	go func() {
+		r.Restart()
+
+		fields := map[string]string{"reason": reason}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		st.events.PublishEvent(Event{
+			Type:   EventResetDone,
+			Source: "txwifi",
+			Time:   time.Now(),
+			Fields: fields,
+		})
+
+		r.mu.Lock()
+		r.running = false
+		r.mu.Unlock()
+	}()
+
+	return err
+}
+
+// wipe removes networks, certificates, state and leases, returning the
+// first error while attempting all of them.
+func (r *Resetter) wipe() error {
+	setupCfg := r.SetupCfg.Load()
+	resetCfg := setupCfg.ResetCfg
+
+	certDir := resetCfg.CertDir
+	if certDir == "" {
+		certDir = defaultResetCertDir
+	}
+	stateDir := resetCfg.StateDir
+	if stateDir == "" {
+		stateDir = defaultResetStateDir
+	}
+
+	var first error
+	try := func(step string, err error) {
+		if err == nil {
+			return
+		}
+		r.Log.Error("Factory reset %s: %s", step, err.Error())
+		if first == nil {
+			first = fmt.Errorf("%s: %s", step, err.Error())
+		}
+	}
+
+	try("networks", clearNetworks(setupCfg.WpaSupplicantCfg.CfgFile))
+	try("certificates", removeContents(certDir))
+	try("state", removeContents(stateDir))
+
+	err := os.Remove(setupCfg.DnsmasqCfg.leaseFile())
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	try("leases", err)
+
+	return first
+}
+
+// Watch fires Reset from a trigger until stop is closed.
+func (r *Resetter) Watch(name string, trigger ResetTrigger, stop <-chan struct{}) {
+	trigger.Watch(stop, func() {
+		if err := r.Reset(name); err != nil {
+			r.Log.Error("Factory reset by %s: %s", name, err.Error())
+		}
+	})
+}
+
+// clearNetworks removes the network blocks of a wpa_supplicant.conf,
+// keeping the global settings.
+func clearNetworks(cfgFile string) error {
+	fi, err := os.Stat(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	cleared := networkBlockR.ReplaceAll(data, nil)
+	cleared = append(bytes.TrimRight(cleared, "\n"), '\n')
+
+	return ioutil.WriteFile(cfgFile, cleared, fi.Mode().Perm())
+}
+
+// removeContents removes everything in dir, keeping dir.
+func removeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package iotwifi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchFileTrigger runs a FileTrigger on path counting its fires until
+// the returned stop function is called.
+func watchFileTrigger(path string) (func() int, func()) {
+	trigger := &FileTrigger{Path: path, Interval: 5 * time.Millisecond}
+
+	fires := make(chan struct{}, 100)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		trigger.Watch(stop, func() { fires <- struct{}{} })
+		close(done)
+	}()
+
+	count := func() int {
+		return len(fires)
+	}
+	stopWatch := func() {
+		close(stop)
+		<-done
+	}
+
+	return count, stopWatch
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return cond()
+}
+
+func TestFileTriggerFiresAndRemoves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txwifi-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "txwifi-reset")
+	fires, stop := watchFileTrigger(path)
+	defer stop()
+
+	time.Sleep(20 * time.Millisecond)
+	if fires() != 0 {
+		t.Fatalf("fired %d times without the file", fires())
+	}
+
+	for want := 1; want <= 2; want++ {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(func() bool { return fires() == want }) {
+			t.Fatalf("fired %d times, want %d", fires(), want)
+		}
+		if !waitFor(func() bool { _, err := os.Stat(path); return os.IsNotExist(err) }) {
+			t.Fatal("trigger file was not removed")
+		}
+	}
+}
+
+func TestFileTriggerFiresOnceUntilRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txwifi-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a directory with contents cannot be removed by os.Remove, even as
+	// root, like a file on a read-only filesystem
+	path := filepath.Join(dir, "txwifi-reset")
+	if err := os.MkdirAll(filepath.Join(path, "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fires, stop := watchFileTrigger(path)
+	defer stop()
+
+	if !waitFor(func() bool { return fires() == 1 }) {
+		t.Fatalf("fired %d times, want 1", fires())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if fires() != 1 {
+		t.Fatalf("fired %d times while the file remained, want 1", fires())
+	}
+
+	// fires again once the file was removed and is back
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return fires() == 2 }) {
+		t.Fatalf("fired %d times, want 2", fires())
+	}
+}
+
+func TestResetRestoresLoadedHostApdCfg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txwifi-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wpaConf := filepath.Join(dir, "wpa_supplicant.conf")
+	if err := ioutil.WriteFile(wpaConf, []byte("network={\n\tssid=\"home\"\n}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &SetupCfg{
+		HostApdCfg:       HostApdCfg{Ssid: "loaded", WpaPassphrase: "loadedpass"},
+		WpaSupplicantCfg: WpaSupplicantCfg{CfgFile: wpaConf},
+		DnsmasqCfg:       DnsmasqCfg{LeaseFile: filepath.Join(dir, "leases")},
+		ResetCfg:         ResetCfg{CertDir: filepath.Join(dir, "certs"), StateDir: filepath.Join(dir, "state")},
+	}
+	running := NewSharedCfg(loaded)
+	running.Update(func(c *SetupCfg) {
+		c.HostApdCfg.Ssid = "changed"
+		c.HostApdCfg.WpaPassphrase = "changedpass"
+	})
+
+	restarted := make(chan HostApdCfg, 1)
+	r := &Resetter{
+		Log:      orNop(nil),
+		SetupCfg: running,
+		Loaded:   NewSharedCfg(loaded),
+		Runner:   NewCmdRunner(nil, NewEventBus()),
+	}
+	r.Restart = func() { restarted <- r.SetupCfg.Load().HostApdCfg }
+
+	if err := r.Reset("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-restarted:
+		if got.Ssid != "loaded" || got.WpaPassphrase != "loadedpass" {
+			t.Errorf("restarted with ssid %q passphrase %q, want the loaded ones", got.Ssid, got.WpaPassphrase)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not restarted")
+	}
+}
+
+// errorLogger records the lines logged at error level.
+type errorLogger struct {
+	nopLogger
+	errors chan string
+}
+
+func (l errorLogger) Error(args ...interface{}) {
+	_, msg := LogArgs(args...)
+	l.errors <- msg
+}
+
+func TestGpioTriggerLogsExportError(t *testing.T) {
+	log := errorLogger{errors: make(chan string, 1)}
+	trigger := &GpioTrigger{Pin: "not-a-pin", Log: log}
+
+	done := make(chan struct{})
+	go func() {
+		trigger.Watch(make(chan struct{}), func() {})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Watch did not return for a pin that cannot be exported")
+	}
+
+	select {
+	case msg := <-log.errors:
+		if !strings.Contains(msg, "not-a-pin") {
+			t.Errorf("logged %q", msg)
+		}
+	default:
+		t.Error("export error not logged")
+	}
+}
@@ -0,0 +1,518 @@
+package iotwifi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultScanInterval is the interval of the background scan.
+const defaultScanInterval = 30 * time.Second
+
+// ErrServiceStarted is returned by Start on a running Service.
+var ErrServiceStarted = errors.New("service already started")
+
+// Service runs hostapd, wpa_supplicant and dnsmasq from one SetupCfg and
+// owns the command runner, the WPA and AP client, factory reset,
+// configuration reload and the state they report, such as ApState and
+// Events. The managed processes and interfaces are device-wide, so a
+// program runs a single Service.
+type Service struct {
+	Log Logger
+
+	location     string
+	scanInterval time.Duration
+
+	// cfg is the running configuration, loaded the configuration
+	// without AP credentials changed at runtime
+	cfg      *SharedCfg
+	loaded   *SharedCfg
+	runner   CmdRunner
+	command  *Command
+	wpa      *WpaCfg
+	resetter *Resetter
+	reloader *Reloader
+	state    *deviceState
+
+	// station counts reconnects for metrics
+	station stationLink
+
+	// hostapdCtrl receives hostapd events of the running AP, guarded
+	// by ctrlMu
+	ctrlMu      sync.Mutex
+	hostapdCtrl *HostapdCtrl
+
+	// ctx is the context of a started service, cancel stops it
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	subs   []*Subscription
+	wg     sync.WaitGroup
+}
+
+// ServiceOption configures a Service.
+type ServiceOption func(*Service)
+
+// WithCfgLocation sets the file or url the configuration was loaded
+// from, enabling Reload and watching it for changes.
+func WithCfgLocation(cfgLocation string) ServiceOption {
+	return func(s *Service) {
+		s.location = cfgLocation
+	}
+}
+
+// WithScanInterval sets the interval of the background scan keeping the
+// results of ScanNetworks current, 30s by default.
+func WithScanInterval(interval time.Duration) ServiceOption {
+	return func(s *Service) {
+		s.scanInterval = interval
+	}
+}
+
+// NewService returns a Service for a loaded configuration. The
+// configuration is used as is, see SetupCfg.Validate. A nil log
+// discards logging.
+func NewService(log Logger, setupCfg *SetupCfg, opts ...ServiceOption) *Service {
+	log = orNop(log)
+	s := &Service{
+		Log:          log,
+		scanInterval: defaultScanInterval,
+		cfg:          NewSharedCfg(setupCfg),
+		loaded:       NewSharedCfg(setupCfg),
+		state:        newDeviceState(nil),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.runner = NewCmdRunner(log, s.state.events)
+	s.runner.state = s.state
+
+	s.command = &Command{
+		Log:      log,
+		Runner:   s.runner,
+		SetupCfg: s.cfg,
+	}
+
+	s.wpa = &WpaCfg{
+		Log:    log,
+		WpaCfg: s.cfg,
+		state:  s.state,
+	}
+
+	s.resetter = &Resetter{
+		Log:      log,
+		SetupCfg: s.cfg,
+		Loaded:   s.loaded,
+		Runner:   s.runner,
+		Restart:  s.restart,
+	}
+
+	s.reloader = &Reloader{
+		Log:      log,
+		Location: s.location,
+		SetupCfg: s.cfg,
+		Loaded:   s.loaded,
+		Wpa:      s.wpa,
+		Restart: map[string]func() error{
+			"hostapd":        s.startAp,
+			"wpa_supplicant": s.startSupplicant,
+			"dnsmasq":        s.startDnsmasq,
+		},
+	}
+
+	return s
+}
+
+// LoadService loads and validates the configuration at cfgLocation once
+// and returns a Service for it that reloads from there.
+func LoadService(log Logger, cfgLocation string, opts ...ServiceOption) (*Service, error) {
+	remote := &remoteStatus{}
+	setupCfg, err := loadCfg(cfgLocation, remote)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupCfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := NewService(log, setupCfg, append([]ServiceOption{WithCfgLocation(cfgLocation)}, opts...)...)
+	s.state.remote = remote
+
+	return s, nil
+}
+
+// Wpa returns the WPA and AP client of the service.
+func (s *Service) Wpa() *WpaCfg {
+	return s.wpa
+}
+
+// Runner returns the command runner of the service.
+func (s *Service) Runner() *CmdRunner {
+	return &s.runner
+}
+
+// Events returns the bus command output and events of the service are
+// published on.
+func (s *Service) Events() *EventBus {
+	return s.state.events
+}
+
+// ApState returns the state of the AP, and the last failure if the state
+// is ApStateFailed.
+func (s *Service) ApState() (string, *ApError) {
+	return s.state.ap.get()
+}
+
+// BootPhase returns the startup phase and the steps that failed, keyed
+// by step name.
+func (s *Service) BootPhase() (string, map[string]string) {
+	return s.state.boot.get()
+}
+
+// Processes returns the state of the managed child processes.
+func (s *Service) Processes() []ProcState {
+	return s.state.procs.list()
+}
+
+// ConnState returns the state of the connection manager.
+func (s *Service) ConnState() ConnStatus {
+	return s.state.conn.get()
+}
+
+// RemoteStatus returns the status of the last fetch of a remote
+// configuration, false when the configuration is not remote.
+func (s *Service) RemoteStatus() (RemoteCfgStatus, bool) {
+	return s.state.remote.get()
+}
+
+// Cfg returns a copy of the running configuration, including reloaded
+// changes.
+func (s *Service) Cfg() SetupCfg {
+	return *s.cfg.Load()
+}
+
+// Reset runs a factory reset, see Resetter.Reset.
+func (s *Service) Reset(reason string) error {
+	return s.resetter.Reset(reason)
+}
+
+// Reload reloads the configuration from its location, see
+// Reloader.Reload.
+func (s *Service) Reload(reason string) (CfgReload, error) {
+	if s.location == "" {
+		return CfgReload{}, ErrReloadUnavailable
+	}
+
+	return s.reloader.Reload(reason)
+}
+
+// Start starts the processes in the background and returns, BootPhase
+// reports their progress. Reset triggers, the connection manager,
+// configuration watching and scanning run until ctx is done or Stop is
+// called.
+func (s *Service) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return ErrServiceStarted
+	}
+
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	ctx = s.ctx
+	s.subscribe()
+
+	s.run(func() {
+		s.boot(ctx)
+		s.background(ctx)
+	})
+
+	return nil
+}
+
+// Stop stops the background work and the processes, waiting for a boot
+// in progress to finish.
+func (s *Service) Stop() {
+	s.mu.Lock()
+	if s.cancel == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.cancel()
+	s.ctx, s.cancel = nil, nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.ctrlMu.Lock()
+	if s.hostapdCtrl != nil {
+		s.hostapdCtrl.Close()
+		s.hostapdCtrl = nil
+	}
+	s.ctrlMu.Unlock()
+	s.state.ap.stop()
+	s.runner.stop("wpa_supplicant")
+	s.runner.stop("dnsmasq")
+
+	s.mu.Lock()
+	for _, sub := range s.subs {
+		sub.Unsubscribe()
+	}
+	s.subs = nil
+	s.mu.Unlock()
+
+	s.Log.Info("IoT Wifi stopped")
+}
+
+// run runs fn in a goroutine Stop waits for.
+func (s *Service) run(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// restart boots the processes again after a factory reset, in the
+// context of the service so Stop waits for it. It does nothing once the
+// service is stopped.
+func (s *Service) restart() {
+	s.mu.Lock()
+	if s.cancel == nil {
+		s.mu.Unlock()
+		return
+	}
+	ctx := s.ctx
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	s.boot(ctx)
+}
+
+// subscribe handles command output, before the processes start so none
+// of their output is missed.
+func (s *Service) subscribe() {
+	// collect DHCP client details for ApClients
+	s.subs = append(s.subs, s.runner.HandleFunc("dnsmasq", func(cmsg CmdMessage) {
+		if cmsg.Event != nil {
+			s.state.dhcp.observe(*cmsg.Event)
+		}
+	}))
+
+	// count station reconnects
+	s.subs = append(s.subs, s.runner.HandleFunc("wpa_supplicant", func(cmsg CmdMessage) {
+		if cmsg.Event != nil {
+			s.station.observe(*cmsg.Event)
+			s.forwardDns(*cmsg.Event)
+		}
+	}))
+
+	// log all command output
+	staticFields := make(map[string]interface{})
+	s.subs = append(s.subs, s.runner.HandleFunc("*", func(out CmdMessage) {
+		staticFields["cmd"] = out.Command
+		logChildLine(s.Log, staticFields, out.Id, out.Message, out.Error)
+	}))
+}
+
+// forwardDns restarts dnsmasq when the station connects or disconnects,
+// so DNS is forwarded upstream only while the station is connected.
+func (s *Service) forwardDns(event Event) {
+	if !s.cfg.Load().DnsmasqCfg.Forward {
+		return
+	}
+
+	var connected bool
+	switch event.Type {
+	case EventStaConnected:
+		connected = true
+	case EventStaDisconnected:
+		connected = false
+	default:
+		return
+	}
+
+	started, upstream := s.command.dnsmasqForwarding()
+	if !started || upstream == connected {
+		return
+	}
+
+	s.Log.Info(map[string]interface{}{"forward": connected}, "Restarting dnsmasq for DNS forwarding")
+	if err := s.startDnsmasq(); err != nil {
+		s.Log.Error("Could not restart dnsmasq: %s", err.Error())
+	}
+}
+
+// timeout returns a start_timeout setting, or the default when invalid.
+func (s *Service) timeout(setting string) time.Duration {
+	d, err := parseStartTimeout(setting)
+	if err != nil {
+		s.Log.Error("Invalid start_timeout %q, using %s", setting, defaultStartTimeout)
+		return defaultStartTimeout
+	}
+
+	return d
+}
+
+// startAp starts hostapd and monitors its events, startSupplicant and
+// startDnsmasq start the other processes, each stopping one started
+// earlier and waiting for it to become ready.
+func (s *Service) startAp() error {
+	hostApdCfg := s.cfg.Load().HostApdCfg
+
+	err := startStep(s.state.boot, "hostapd",
+		s.timeout(hostApdCfg.StartTimeout),
+		startRetries(hostApdCfg.StartRetries),
+		s.wpa.StartAP,
+		apReady,
+	)
+	if err != nil {
+		return err
+	}
+
+	// log AP client connects and disconnects, startAp runs concurrently
+	// on reloads and connection manager recovery
+	s.ctrlMu.Lock()
+	defer s.ctrlMu.Unlock()
+
+	if s.hostapdCtrl != nil {
+		s.hostapdCtrl.Close()
+	}
+	s.hostapdCtrl, err = s.wpa.HostapdEvents(func(event HostapdEvent) {
+		if event.Mac != "" {
+			s.Log.Info(map[string]interface{}{"mac": event.Mac, "event": event.Type}, "Hostapd event")
+		}
+	})
+	if err != nil {
+		s.Log.Error("Could not monitor hostapd events: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *Service) startSupplicant() error {
+	supplicantCfg := s.cfg.Load().WpaSupplicantCfg
+
+	return startStep(s.state.boot, "wpa_supplicant",
+		s.timeout(supplicantCfg.StartTimeout),
+		startRetries(supplicantCfg.StartRetries),
+		s.command.StartWpaSupplicant,
+		supplicantReady,
+	)
+}
+
+func (s *Service) startDnsmasq() error {
+	setupCfg := s.cfg.Load()
+
+	return startStep(s.state.boot, "dnsmasq",
+		s.timeout(setupCfg.DnsmasqCfg.StartTimeout),
+		startRetries(setupCfg.DnsmasqCfg.StartRetries),
+		s.command.StartDnsmasq,
+		func() error { return dnsmasqReady(s.cfg.Load().HostApdCfg.Ip) },
+	)
+}
+
+// boot starts hostapd, wpa_supplicant and dnsmasq in order, waiting for
+// each to become ready, at startup and after a factory reset. It stops
+// between steps once ctx is done.
+func (s *Service) boot(ctx context.Context) {
+	// AP
+	s.state.boot.reset()
+	err := s.startAp()
+	if err != nil {
+		s.Log.Error("Could not start AP, continuing in station mode: %s", err.Error())
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Station
+	s.state.boot.set(BootStartingSupplicant)
+	err = s.startSupplicant()
+	if err != nil {
+		s.Log.Error("Could not start wpa_supplicant: %s", err.Error())
+	}
+
+	// Scan
+	if err == nil {
+		s.wpa.ScanNetworks()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	// DHCP and DNS for AP clients
+	s.state.boot.set(BootStartingDnsmasq)
+	err = s.startDnsmasq()
+	if err != nil {
+		s.Log.Error("Could not start dnsmasq: %s", err.Error())
+	}
+
+	s.state.boot.done()
+	phase, _ := s.BootPhase()
+	s.Log.Info("IoT Wifi startup %s", phase)
+}
+
+// background starts the reset triggers, connection manager and
+// configuration watch, then scans until ctx is done.
+func (s *Service) background(ctx context.Context) {
+	stop := ctx.Done()
+	setupCfg := s.cfg.Load()
+
+	// factory reset by triggers
+	if setupCfg.ResetCfg.TriggerFile != "" {
+		s.run(func() {
+			s.resetter.Watch("file", &FileTrigger{Path: setupCfg.ResetCfg.TriggerFile, Log: s.Log}, stop)
+		})
+	}
+	if setupCfg.ResetCfg.GpioPin != "" {
+		trigger := &GpioTrigger{
+			Pin:  setupCfg.ResetCfg.GpioPin,
+			Hold: connDuration(setupCfg.ResetCfg.GpioHold, defaultResetGpioHold),
+			Log:  s.Log,
+		}
+		s.run(func() { s.resetter.Watch("gpio", trigger, stop) })
+	}
+
+	// reconnect across saved networks and recover from outages
+	if !setupCfg.ConnMgrCfg.Disabled {
+		connMgr := NewConnManager(s.Log, s.wpa, setupCfg.ConnMgrCfg, map[string]func() error{
+			RecoverRestartSupplicant: s.startSupplicant,
+			RecoverEnableAp: func() error {
+				switch state, _ := s.ApState(); state {
+				case ApStateEnabled:
+					return nil
+				case ApStateDisabled:
+					return s.wpa.EnableAp()
+				}
+				return s.startAp()
+			},
+		})
+		s.run(func() { connMgr.Run(stop) })
+	}
+
+	// reload changed configurations, restarting only what changed
+	if s.location != "" {
+		if interval := reloadInterval(s.location); interval > 0 {
+			s.run(func() { s.reloader.Watch(interval, stop) })
+		}
+	}
+
+	// TODO: check to see if we are stuck in a scanning state before
+	// if in a scanning state set a timeout before resetting
+	ticker := time.NewTicker(s.scanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.wpa.ScanNetworks()
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package iotwifi
+
+import "testing"
+
+func TestServiceRestartSkippedWhenStopped(t *testing.T) {
+	s := NewService(nil, &SetupCfg{})
+
+	// a reset finishing after Stop must not boot the processes again
+	s.restart()
+
+	if phase, failures := s.BootPhase(); phase != BootStartingAp || len(failures) > 0 {
+		t.Errorf("stopped service booted: phase %s, failures %v", phase, failures)
+	}
+}
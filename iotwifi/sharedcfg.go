@@ -0,0 +1,47 @@
+package iotwifi
+
+import "sync"
+
+// SharedCfg is the configuration shared by the parts of a Service.
+// Changes replace it whole, so readers take a snapshot with Load and
+// never modify it.
+type SharedCfg struct {
+	mu sync.RWMutex
+	c  *SetupCfg
+}
+
+// NewSharedCfg shares c, which must not be modified afterwards.
+func NewSharedCfg(c *SetupCfg) *SharedCfg {
+	return &SharedCfg{c: c}
+}
+
+// Load returns a snapshot of the configuration.
+func (s *SharedCfg) Load() *SetupCfg {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.c
+}
+
+// Store replaces the configuration with c, which must not be modified
+// afterwards.
+func (s *SharedCfg) Store(c *SetupCfg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.c = c
+}
+
+// Update replaces the configuration with a copy changed by f. Slices and
+// maps of the copy are those of the snapshot, f replaces them rather
+// than changing them.
+func (s *SharedCfg) Update(f func(c *SetupCfg)) *SetupCfg {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := *s.c
+	f(&next)
+	s.c = &next
+
+	return s.c
+}
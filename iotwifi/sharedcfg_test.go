@@ -0,0 +1,29 @@
+package iotwifi
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSharedCfgUpdateKeepsSnapshots(t *testing.T) {
+	shared := NewSharedCfg(&SetupCfg{HostApdCfg: HostApdCfg{Ssid: "old", Channel: "6"}})
+	snapshot := shared.Load()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shared.Update(func(c *SetupCfg) { c.HostApdCfg.Ssid = "new" })
+			_ = shared.Load().HostApdCfg.Ssid
+		}()
+	}
+	wg.Wait()
+
+	if snapshot.HostApdCfg.Ssid != "old" {
+		t.Errorf("snapshot changed to %q", snapshot.HostApdCfg.Ssid)
+	}
+	if got := shared.Load().HostApdCfg; got.Ssid != "new" || got.Channel != "6" {
+		t.Errorf("got %+v after update", got)
+	}
+}
@@ -0,0 +1,44 @@
+package iotwifi
+
+import "sync"
+
+// deviceState is the state of the processes and AP a Service manages:
+// the bus their output and events are published on, the AP, boot and
+// process states, DHCP clients, the connection manager status and the
+// last remote configuration fetch.
+type deviceState struct {
+	events *EventBus
+	ap     *apStatus
+	boot   *bootStatus
+	procs  *processTable
+	dhcp   *dhcpObserver
+	conn   *connStatus
+	remote *remoteStatus
+
+	// station serializes network selection by ConnectNetwork and the
+	// connection manager
+	station sync.Mutex
+}
+
+// newDeviceState returns the state of nothing started yet, publishing on
+// bus, or on a new bus when it is nil.
+func newDeviceState(bus *EventBus) *deviceState {
+	if bus == nil {
+		bus = NewEventBus()
+	}
+
+	st := &deviceState{
+		events: bus,
+		ap:     &apStatus{state: ApStateStopped},
+		boot:   &bootStatus{phase: BootStartingAp, failures: make(map[string]string)},
+		procs:  &processTable{procs: make(map[string]*ProcState)},
+		dhcp: &dhcpObserver{
+			pending: make(map[string]dhcpClientInfo),
+			clients: make(map[string]dhcpClientInfo),
+		},
+		remote: &remoteStatus{},
+	}
+	st.conn = &connStatus{status: ConnStatus{State: ConnStateIdle}, events: st.events}
+
+	return st
+}
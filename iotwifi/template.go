@@ -0,0 +1,184 @@
+package iotwifi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const (
+	deviceMacFile = "/sys/class/net/wlan0/address"
+	cpuInfoFile   = "/proc/cpuinfo"
+
+	// passphraseAlphabet leaves out characters easily misread on a label.
+	passphraseAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+)
+
+// deviceInfo holds the passphrase secret of a device for templates.
+type deviceInfo struct {
+	secret string
+}
+
+// readDeviceMac returns the wlan0 MAC address in upper case hex without
+// separators.
+func readDeviceMac() (string, error) {
+	data, err := ioutil.ReadFile(deviceMacFile)
+	if err != nil {
+		return "", err
+	}
+
+	mac := strings.Replace(strings.TrimSpace(string(data)), ":", "", -1)
+
+	return strings.ToUpper(mac), nil
+}
+
+// readCpuSerial returns the Serial of /proc/cpuinfo without leading zeros.
+func readCpuSerial() (string, error) {
+	file, err := os.Open(cpuInfoFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "Serial" {
+			return strings.TrimLeft(strings.TrimSpace(kv[1]), "0"), nil
+		}
+	}
+
+	return "", errors.New("no serial in " + cpuInfoFile)
+}
+
+// suffix returns the last n characters of s.
+func suffix(s string, n int) string {
+	if n <= 0 || n >= len(s) {
+		return s
+	}
+
+	return s[len(s)-n:]
+}
+
+// funcs returns the template functions. Values that cannot be read are
+// errors only when a template uses them.
+func (d *deviceInfo) funcs() template.FuncMap {
+	mac := readDeviceMac
+	serial := readCpuSerial
+
+	return template.FuncMap{
+		"mac": mac,
+		"mac_suffix": func(n int) (string, error) {
+			m, err := mac()
+			return suffix(m, n), err
+		},
+		"serial": serial,
+		"serial_suffix": func(n int) (string, error) {
+			s, err := serial()
+			return suffix(s, n), err
+		},
+		"hostname": os.Hostname,
+		"env":      os.Getenv,
+		"file": func(path string) (string, error) {
+			data, err := ioutil.ReadFile(path)
+			return strings.TrimSpace(string(data)), err
+		},
+		"derived_passphrase": func(n int) (string, error) {
+			if d.secret == "" {
+				return "", errors.New("derived_passphrase needs passphrase_secret")
+			}
+			id, err := serial()
+			if err != nil || id == "" {
+				if id, err = mac(); err != nil {
+					return "", err
+				}
+			}
+			return derivePassphrase(d.secret, id, n), nil
+		},
+	}
+}
+
+// expand executes a template string, strings without actions are
+// returned unchanged.
+func (d *deviceInfo) expand(name string, text string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(d.funcs()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// derivePassphrase derives a passphrase of n characters from secret and
+// a device id, the same inputs always give the same passphrase.
+func derivePassphrase(secret string, id string, n int) string {
+	if n < 8 {
+		n = 8
+	}
+	if n > 63 {
+		n = 63
+	}
+
+	passphrase := make([]byte, 0, n)
+	for block := 0; len(passphrase) < n; block++ {
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%s:%d", id, block)
+
+		for _, b := range mac.Sum(nil) {
+			// skip bytes above the largest multiple of the alphabet size
+			// so every character is equally likely
+			if int(b) >= 256-256%len(passphraseAlphabet) {
+				continue
+			}
+			passphrase = append(passphrase, passphraseAlphabet[int(b)%len(passphraseAlphabet)])
+			if len(passphrase) == n {
+				break
+			}
+		}
+	}
+
+	return string(passphrase)
+}
+
+// expandApTemplates expands the templates of the AP ssid and passphrase,
+// see the README for the available functions.
+func expandApTemplates(c *HostApdCfg) error {
+	device := &deviceInfo{}
+
+	secret, err := device.expand("passphrase_secret", c.PassphraseSecret)
+	if err != nil {
+		return fmt.Errorf("host_apd_cfg.passphrase_secret: %s", err.Error())
+	}
+	device.secret = secret
+
+	ssid, err := device.expand("ssid", c.Ssid)
+	if err != nil {
+		return fmt.Errorf("host_apd_cfg.ssid: %s", err.Error())
+	}
+
+	passphrase, err := device.expand("wpa_passphrase", c.WpaPassphrase)
+	if err != nil {
+		return fmt.Errorf("host_apd_cfg.wpa_passphrase: %s", err.Error())
+	}
+
+	c.Ssid = ssid
+	c.WpaPassphrase = passphrase
+
+	return nil
+}
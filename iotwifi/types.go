@@ -5,13 +5,42 @@ type SetupCfg struct {
 	DnsmasqCfg       DnsmasqCfg       `json:"dnsmasq_cfg"`
 	HostApdCfg       HostApdCfg       `json:"host_apd_cfg"`
 	WpaSupplicantCfg WpaSupplicantCfg `json:"wpa_supplicant_cfg"`
+	LogCfg           LogCfg           `json:"log_cfg"`
+	ConnMgrCfg       ConnMgrCfg       `json:"conn_mgr_cfg"`
+	ResetCfg         ResetCfg         `json:"reset_cfg"`
 }
 
 // DnsmasqCfg configures dnsmasq and is used by SetupCfg.
 type DnsmasqCfg struct {
-	Address     string `json:"address"`      // --address=/#/192.168.27.1",
-	DhcpRange   string `json:"dhcp_range"`   // "--dhcp-range=192.168.27.100,192.168.27.150,1h",
-	VendorClass string `json:"vendor_class"` // "--dhcp-vendorclass=set:device,IoT",
+	Address      string        `json:"address"`       // --address=/#/192.168.27.1",
+	DhcpRange    string        `json:"dhcp_range"`    // "--dhcp-range=192.168.27.100,192.168.27.150,1h",
+	VendorClass  string        `json:"vendor_class"`  // "--dhcp-vendorclass=set:device,IoT",
+	Addresses    []string      `json:"addresses"`     // address=/example.com/192.168.27.1
+	Forward      bool          `json:"forward"`       // forward DNS upstream once the station is connected
+	Servers      []string      `json:"servers"`       // server=8.8.8.8
+	ResolvFile   string        `json:"resolv_file"`   // resolv-file=/etc/resolv.conf
+	DhcpHosts    []DnsmasqHost `json:"dhcp_hosts"`    // dhcp-host=b8:27:eb:00:00:01,192.168.27.10,sensor
+	DhcpOptions  []DnsmasqOpt  `json:"dhcp_options"`  // dhcp-option=option:router,192.168.27.1
+	LeaseTime    string        `json:"lease_time"`    // 1h
+	LeaseFile    string        `json:"lease_file"`    // dhcp-leasefile=/var/lib/misc/dnsmasq.leases
+	ConfFile     string        `json:"conf_file"`     // /var/run/txwifi/dnsmasq.conf
+	StartTimeout string        `json:"start_timeout"` // 30s
+	StartRetries int           `json:"start_retries"` // 2
+}
+
+// DnsmasqHost is a static DHCP reservation and is used by DnsmasqCfg.
+type DnsmasqHost struct {
+	Mac       string `json:"mac"`        // b8:27:eb:00:00:01
+	Ip        string `json:"ip"`         // 192.168.27.10
+	Hostname  string `json:"hostname"`   // sensor
+	LeaseTime string `json:"lease_time"` // infinite
+}
+
+// DnsmasqOpt is a DHCP option sent to clients and is used by DnsmasqCfg.
+type DnsmasqOpt struct {
+	Tag    string `json:"tag"`    // device
+	Option string `json:"option"` // router, dns-server, domain-name or a number
+	Value  string `json:"value"`  // 192.168.27.1
 }
 
 // HostApdCfg configures hostapd and is used by SetupCfg.
@@ -20,9 +49,52 @@ type HostApdCfg struct {
 	WpaPassphrase string `json:"wpa_passphrase"` // wpa_passphrase=iotwifipass
 	Channel       string `json:"channel"`        //  channel=6
 	Ip            string `json:"ip"`             // 192.168.27.1
+	Netmask       string `json:"netmask"`        // 255.255.255.0 or 24
+	StartTimeout  string `json:"start_timeout"`  // 30s
+	StartRetries  int    `json:"start_retries"`  // 2
+	CfgFile       string `json:"cfg_file"`       // /var/run/txwifi/hostapd.conf
+
+	PassphraseSecret string `json:"passphrase_secret"` // {{env "TXWIFI_AP_SECRET"}}
 }
 
 // WpaSupplicantCfg configures wpa_supplicant and is used by SetupCfg
 type WpaSupplicantCfg struct {
-	CfgFile string `json:"cfg_file"` // /etc/wpa_supplicant/wpa_supplicant.conf
+	CfgFile      string `json:"cfg_file"`      // /etc/wpa_supplicant/wpa_supplicant.conf
+	StartTimeout string `json:"start_timeout"` // 30s
+	StartRetries int    `json:"start_retries"` // 2
+}
+
+// LogCfg configures logging and is used by SetupCfg.
+type LogCfg struct {
+	Level   string            `json:"level"`   // info
+	Format  string            `json:"format"`  // json or text
+	Sources map[string]string `json:"sources"` // {"dnsmasq": "warn", "hostapd": "info"}
+	File    LogFileCfg        `json:"file"`
+}
+
+// LogFileCfg configures a size rotated log file and is used by LogCfg.
+type LogFileCfg struct {
+	Path       string `json:"path"`        // /var/log/txwifi/wifi.log
+	MaxSizeMb  int    `json:"max_size_mb"` // 10
+	MaxBackups int    `json:"max_backups"` // 3
+}
+
+// ConnMgrCfg configures the connection manager and is used by SetupCfg.
+type ConnMgrCfg struct {
+	Disabled        bool     `json:"disabled"`         // false
+	CheckInterval   string   `json:"check_interval"`   // 10s
+	BackoffMin      string   `json:"backoff_min"`      // 5s
+	BackoffMax      string   `json:"backoff_max"`      // 5m
+	AttemptTimeout  string   `json:"attempt_timeout"`  // 30s
+	RecoveryAfter   string   `json:"recovery_after"`   // 10m
+	RecoveryActions []string `json:"recovery_actions"` // ["restart_supplicant", "enable_ap"]
+}
+
+// ResetCfg configures factory reset and is used by SetupCfg.
+type ResetCfg struct {
+	CertDir     string `json:"cert_dir"`     // /etc/txwifi/certs
+	StateDir    string `json:"state_dir"`    // /var/lib/txwifi
+	TriggerFile string `json:"trigger_file"` // /boot/txwifi-reset
+	GpioPin     string `json:"gpio_pin"`     // 17
+	GpioHold    string `json:"gpio_hold"`    // 5s
 }
@@ -0,0 +1,213 @@
+package iotwifi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// FieldError is an invalid configuration field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error implements error.
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors are all invalid fields of a configuration.
+type ValidationErrors []FieldError
+
+// Error implements error, one field per line.
+func (v ValidationErrors) Error() string {
+	lines := make([]string, len(v))
+	for i, e := range v {
+		lines[i] = e.Error()
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// isTemplate reports whether a value is an unexpanded template.
+func isTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// Validate checks the configuration, returning ValidationErrors for
+// every invalid field. Unexpanded ssid and passphrase templates are only
+// checked for syntax.
+func (c *SetupCfg) Validate() error {
+	return c.validate(true)
+}
+
+// validate is Validate, checking the files the configuration refers to
+// on this device with deviceFiles set.
+func (c *SetupCfg) validate(deviceFiles bool) error {
+	errs := ValidationErrors{}
+	fail := func(field string, format string, a ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+	duration := func(field string, value string) {
+		if value == "" {
+			return
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			fail(field, "%q is not a positive duration such as 30s", value)
+		}
+	}
+
+	// AP
+	ap := c.HostApdCfg
+	if net.ParseIP(ap.Ip).To4() == nil {
+		fail("host_apd_cfg.ip", "%q is not an IPv4 address", ap.Ip)
+	} else if _, err := ap.subnet(); err != nil {
+		fail("host_apd_cfg.netmask", "%s", err.Error())
+	} else if err, ok := c.DnsmasqCfg.Validate(&ap).(ValidationErrors); ok {
+		errs = append(errs, err...)
+	}
+
+	for _, t := range [][2]string{
+		{"host_apd_cfg.ssid", ap.Ssid},
+		{"host_apd_cfg.wpa_passphrase", ap.WpaPassphrase},
+		{"host_apd_cfg.passphrase_secret", ap.PassphraseSecret},
+	} {
+		field, value := t[0], t[1]
+		if isTemplate(value) {
+			if _, err := template.New(field).Funcs((&deviceInfo{}).funcs()).Parse(value); err != nil {
+				fail(field, "invalid template: %s", err.Error())
+			}
+		}
+	}
+
+	if !isTemplate(ap.Ssid) {
+		if err := checkSsid(ap.Ssid); err != nil {
+			fail("host_apd_cfg.ssid", "%s", err.Error())
+		}
+	}
+
+	if !isTemplate(ap.WpaPassphrase) {
+		if err := checkPassphrase(ap.WpaPassphrase); err != nil {
+			fail("host_apd_cfg.wpa_passphrase", "%s", err.Error())
+		}
+	}
+
+	// hw_mode=g, 2.4 GHz
+	if channel, err := strconv.Atoi(ap.Channel); err != nil || channel < 1 || channel > 14 {
+		fail("host_apd_cfg.channel", "%q is not a 2.4 GHz channel (1 to 14)", ap.Channel)
+	}
+
+	duration("host_apd_cfg.start_timeout", ap.StartTimeout)
+	duration("dnsmasq_cfg.start_timeout", c.DnsmasqCfg.StartTimeout)
+	duration("wpa_supplicant_cfg.start_timeout", c.WpaSupplicantCfg.StartTimeout)
+
+	// station
+	if c.WpaSupplicantCfg.CfgFile == "" {
+		fail("wpa_supplicant_cfg.cfg_file", "is required")
+	} else if deviceFiles {
+		if err := checkSupplicantCfg(c.WpaSupplicantCfg.CfgFile); err != "" {
+			fail("wpa_supplicant_cfg.cfg_file", "%s", err)
+		}
+	}
+
+	// logging
+	if c.LogCfg.Level != "" {
+		if _, err := parseLogLevel(c.LogCfg.Level); err != nil {
+			fail("log_cfg.level", "%s", err.Error())
+		}
+	}
+	sources := make([]string, 0, len(c.LogCfg.Sources))
+	for source := range c.LogCfg.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		if _, err := parseLogLevel(c.LogCfg.Sources[source]); err != nil {
+			fail("log_cfg.sources."+source, "%s", err.Error())
+		}
+	}
+	switch c.LogCfg.Format {
+	case "", LogFormatJson, LogFormatText:
+	default:
+		fail("log_cfg.format", "%q is not json or text", c.LogCfg.Format)
+	}
+
+	// connection manager
+	connMgr := c.ConnMgrCfg
+	duration("conn_mgr_cfg.check_interval", connMgr.CheckInterval)
+	duration("conn_mgr_cfg.backoff_min", connMgr.BackoffMin)
+	duration("conn_mgr_cfg.backoff_max", connMgr.BackoffMax)
+	duration("conn_mgr_cfg.attempt_timeout", connMgr.AttemptTimeout)
+	duration("conn_mgr_cfg.recovery_after", connMgr.RecoveryAfter)
+	for _, action := range connMgr.RecoveryActions {
+		if action != RecoverRestartSupplicant && action != RecoverEnableAp {
+			fail("conn_mgr_cfg.recovery_actions", "unknown action %q", action)
+		}
+	}
+
+	// reset
+	if pin := c.ResetCfg.GpioPin; pin != "" {
+		if _, err := strconv.Atoi(pin); err != nil {
+			fail("reset_cfg.gpio_pin", "%q is not a GPIO number", pin)
+		}
+	}
+	duration("reset_cfg.gpio_hold", c.ResetCfg.GpioHold)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// checkSupplicantCfg checks that a wpa_supplicant.conf exists and allows
+// wpa_cli to control and save it, returning a problem or "".
+func checkSupplicantCfg(cfgFile string) string {
+	file, err := os.Open(cfgFile)
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	ctrlInterface, updateConfig := false, false
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "ctrl_interface="):
+			ctrlInterface = true
+		case line == "update_config=1":
+			updateConfig = true
+		}
+	}
+
+	switch {
+	case !ctrlInterface:
+		return cfgFile + " has no ctrl_interface, wpa_cli cannot reach wpa_supplicant"
+	case !updateConfig:
+		return cfgFile + " has no update_config=1, connected networks cannot be saved"
+	}
+
+	return ""
+}
+
+// ValidateCfg reads and validates a configuration without expanding the
+// AP templates, for checking configurations off the device. Urls are
+// fetched without touching the cache. The files it refers to, such as
+// wpa_supplicant.conf, are checked on this device with deviceFiles set.
+func ValidateCfg(cfgLocation string, deviceFiles bool) error {
+	setupCfg, err := readCfgFrom(cfgLocation, false, nil)
+	if err != nil {
+		return err
+	}
+
+	return setupCfg.validate(deviceFiles)
+}
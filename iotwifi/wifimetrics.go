@@ -0,0 +1,110 @@
+package iotwifi
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Wifi and service metrics, see WriteMetrics.
+var (
+	metricStationConnected = NewGauge("txwifi_station_connected",
+		"1 when wpa_supplicant reports wpa_state COMPLETED.")
+	metricStationRssi = NewGauge("txwifi_station_rssi_dbm",
+		"Station signal strength from signal_poll.")
+	metricStationLinkSpeed = NewGauge("txwifi_station_link_speed_mbps",
+		"Station link speed from signal_poll.")
+	metricStationFrequency = NewGauge("txwifi_station_frequency_mhz",
+		"Station frequency from signal_poll.")
+	metricStationReconnects = NewCounter("txwifi_station_reconnects_total",
+		"Station connects following a disconnect from an earlier connection.")
+	metricScans = NewCounter("txwifi_scans_total",
+		"Network scans by outcome.", "outcome")
+	metricScanDuration = NewHistogram("txwifi_scan_duration_seconds",
+		"Duration of network scans including result retrieval.", nil)
+	metricConnectAttempts = NewCounter("txwifi_connect_attempts_total",
+		"Connect attempts by outcome and reason, the reason is the last wpa_state seen or the failing step.", "outcome", "reason")
+	metricApClients = NewGauge("txwifi_ap_clients",
+		"Clients associated with the setup AP.")
+	metricProcessUp = NewGauge("txwifi_process_up",
+		"1 when the managed child process is running.", "process")
+	metricProcessRestarts = NewCounter("txwifi_process_restarts_total",
+		"Restarts of managed child processes.", "process")
+	metricBusDropped = NewCounter("txwifi_bus_dropped_total",
+		"Event bus messages dropped for a full subscriber buffer, by subscription topic.", "topic")
+)
+
+// stationLink follows the station connection to count reconnects.
+type stationLink struct {
+	mu sync.Mutex
+
+	// connected is set once the station has connected, lost when it
+	// disconnects afterwards
+	connected bool
+	lost      bool
+}
+
+// observe updates metrics from a wpa_supplicant event. The first connect
+// is not a reconnect, nor is one without a disconnect before it.
+func (l *stationLink) observe(event Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch event.Type {
+	case EventStaConnected:
+		if l.connected && l.lost {
+			metricStationReconnects.Inc()
+		}
+		l.connected = true
+		l.lost = false
+	case EventStaDisconnected:
+		l.lost = l.connected
+	}
+}
+
+// CollectMetrics refreshes the metrics derived from Status, the AP client
+// list and the managed processes. It is called before WriteMetrics.
+func (wpa *WpaCfg) CollectMetrics() {
+	status, err := wpa.Status()
+	if err == nil {
+		connected := 0.0
+		if status["wpa_state"] == "COMPLETED" {
+			connected = 1
+		}
+		metricStationConnected.Set(connected)
+
+		gauges := map[string]*Gauge{
+			"rssi":      metricStationRssi,
+			"linkspeed": metricStationLinkSpeed,
+			"frequency": metricStationFrequency,
+		}
+		for key, gauge := range gauges {
+			if v, err := strconv.ParseFloat(status[key], 64); err == nil && connected == 1 {
+				gauge.Set(v)
+			} else {
+				gauge.Delete()
+			}
+		}
+	}
+
+	if apClients, err := wpa.ApClients(); err == nil {
+		associated := 0
+		for _, client := range apClients {
+			if client.Associated {
+				associated++
+			}
+		}
+		metricApClients.Set(float64(associated))
+	}
+
+	for _, proc := range wpa.st().procs.list() {
+		up := 0.0
+		if proc.Running {
+			up = 1
+		}
+		metricProcessUp.Set(up, proc.Id)
+
+		if proc.Starts > 0 {
+			metricProcessRestarts.Set(float64(proc.Starts-1), proc.Id)
+		}
+	}
+}
@@ -3,19 +3,31 @@ package iotwifi
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
-
-	"github.com/bhoriuchi/go-bunyan/bunyan"
 )
 
+// hostapdCtrlDir is the hostapd control interface directory.
+const hostapdCtrlDir = "/var/run/hostapd"
+
 // WpaCfg for configuring wpa
 type WpaCfg struct {
-	Log    bunyan.Logger
+	Log    Logger
 	WpaCmd []string
-	WpaCfg *SetupCfg
+	WpaCfg *SharedCfg
+
+	// state is the state of the Service that created wpa, created on
+	// first use otherwise
+	state     *deviceState
+	stateOnce sync.Once
 }
 
 // WpaNetwork defines a wifi network to connect to.
@@ -41,10 +53,15 @@ type WpaConnection struct {
 	Message string `json:"message"`
 }
 
-// NewWpaCfg produces WpaCfg configuration types.
-func NewWpaCfg(log bunyan.Logger, cfgLocation string) *WpaCfg {
+// NewWpaCfg produces WpaCfg configuration types, loading the
+// configuration again.
+//
+// Deprecated: use Service.Wpa, which shares the configuration of the
+// running processes.
+func NewWpaCfg(log Logger, cfgLocation string) *WpaCfg {
+	log = orNop(log)
 
-	setupCfg, err := loadCfg(cfgLocation)
+	setupCfg, err := loadCfg(cfgLocation, nil)
 	if err != nil {
 		log.Error("Could not load config: %s", err.Error())
 		panic(err)
@@ -52,13 +69,30 @@ func NewWpaCfg(log bunyan.Logger, cfgLocation string) *WpaCfg {
 
 	return &WpaCfg{
 		Log:    log,
-		WpaCfg: setupCfg,
+		WpaCfg: NewSharedCfg(setupCfg),
+		state:  newDeviceState(nil),
 	}
 }
 
-// StartAP starts AP mode.
-func (wpa *WpaCfg) StartAP() {
+// st returns the state wpa reports on and changes.
+func (wpa *WpaCfg) st() *deviceState {
+	wpa.stateOnce.Do(func() {
+		if wpa.state == nil {
+			wpa.state = newDeviceState(nil)
+		}
+	})
+
+	return wpa.state
+}
+
+// StartAP starts AP mode. It returns once hostapd reports AP-ENABLED, or
+// with an *ApError when hostapd exits, disables the AP or does not
+// become ready within HostApdCfg.StartTimeout.
+func (wpa *WpaCfg) StartAP() error {
+	st := wpa.st()
 	wpa.Log.Info("Starting Hostapd.")
+	st.ap.stop()
+	st.ap.set(ApStateStarting, nil)
 
 	command := &Command{
 		Log:      wpa.Log,
@@ -70,84 +104,241 @@ func (wpa *WpaCfg) StartAP() {
 	command.UpApInterface()
 	command.ConfigureApInterface()
 
-	cmd := exec.Command("hostapd", "-d", "/dev/stdin")
+	hostApdCfg := wpa.WpaCfg.Load().HostApdCfg
+
+	timeout, err := parseStartTimeout(hostApdCfg.StartTimeout)
+	if err != nil {
+		return st.ap.fail(ApFailConfig, 0, err.Error())
+	}
+
+	cfgFile, err := hostApdCfg.writeConf()
+	if err != nil {
+		return st.ap.fail(ApFailStart, 0, err.Error())
+	}
+
+	cmd := exec.Command("hostapd", "-d", cfgFile)
 
 	// pipes
-	hostapdPipe, _ := cmd.StdinPipe()
 	cmdStdoutReader, err := cmd.StdoutPipe()
 	if err != nil {
-		panic(err)
+		return st.ap.fail(ApFailStart, 0, err.Error())
+	}
+	cmdStderrReader, err := cmd.StderrPipe()
+	if err != nil {
+		return st.ap.fail(ApFailStart, 0, err.Error())
 	}
 
-	messages := make(chan string, 1)
-	blocked := true
+	// AP-ENABLED/AP-DISABLED, buffered so the readers never block
+	apEvents := make(chan string, 2)
 
-	stdOutScanner := bufio.NewScanner(cmdStdoutReader)
-	go func() {
-		for stdOutScanner.Scan() {
-			wpa.Log.Info("HOSTAPD GOT: %s", stdOutScanner.Text())
-			if blocked {
-				messages <- stdOutScanner.Text()
+	scan := func(reader io.Reader, isError bool) {
+		fields := map[string]interface{}{"cmd": "hostapd"}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := scanner.Text()
+			st.ap.line(line)
+
+			logChildLine(wpa.Log, fields, "hostapd", line, isError)
+
+			event, ok := ParseEvent("hostapd", line)
+			if !ok {
+				continue
+			}
+			st.events.PublishEvent(event)
+
+			if event.Fields["interface"] != "uap0" {
+				continue
+			}
+			switch event.Type {
+			case EventApEnabled:
+				select {
+				case apEvents <- ApStateEnabled:
+				default:
+				}
+			case EventApDisabled:
+				select {
+				case apEvents <- ApStateDisabled:
+				default:
+				}
 			}
 		}
+	}
+
+	wpa.Log.Info("Hostapd CFG: %s", cfgFile)
+
+	err = cmd.Start()
+	if err != nil {
+		return st.ap.fail(ApFailStart, 0, err.Error())
+	}
+	st.ap.setCmd(cmd)
+	st.procs.started("hostapd", cmd)
+
+	// Wait closes the pipes, so it waits for the scanners to read the last
+	// lines naming the failure
+	var scanners sync.WaitGroup
+	scanners.Add(2)
+	go func() {
+		defer scanners.Done()
+		scan(cmdStdoutReader, false)
+	}()
+	go func() {
+		defer scanners.Done()
+		scan(cmdStderrReader, true)
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		scanners.Wait()
+		err := cmd.Wait()
+		st.procs.exited("hostapd", cmd, err)
+		exited <- err
 	}()
 
-	cfg := `interface=uap0
-ssid=` + wpa.WpaCfg.HostApdCfg.Ssid + `
-hw_mode=g
-channel=` + wpa.WpaCfg.HostApdCfg.Channel + `
-macaddr_acl=0
-auth_algs=1
-ignore_broadcast_ssid=0
-wpa=2
-wpa_passphrase=` + wpa.WpaCfg.HostApdCfg.WpaPassphrase + `
-wpa_key_mgmt=WPA-PSK
-wpa_pairwise=TKIP
-rsn_pairwise=CCMP`
-
-	wpa.Log.Info("Hostapd CFG: %s", cfg)
-	hostapdPipe.Write([]byte(cfg))
-
-	cmd.Start()
-	hostapdPipe.Close()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
 	for {
-		out := <-messages // Block until we receive a message on the channel
-		if strings.Contains(out, "uap0: AP-DISABLED") {
+		select {
+		case state := <-apEvents:
+			if state == ApStateEnabled {
+				wpa.Log.Info("Hostapd ENABLED")
+				st.ap.set(ApStateEnabled, nil)
+				go wpa.watchAP(cmd, exited)
+				return nil
+			}
+
 			wpa.Log.Info("Hostapd DISABLED")
-			//cmd.Process.Kill()
-			//cmd.Wait()
+			go wpa.watchAP(cmd, exited)
+			apErr := st.ap.fail(ApFailDisabled, 0, "AP-DISABLED during startup")
+			wpa.Log.Error(apErr.Error())
+			return apErr
+
+		case err := <-exited:
+			apErr := st.ap.exited(cmd, exitStatus(err), "hostapd exited during startup")
+			if apErr == nil {
+				// stopped by a reset, reload or another StartAP
+				return &ApError{Reason: ApFailExited, ExitStatus: exitStatus(err), Message: "hostapd stopped during startup"}
+			}
+			wpa.Log.Error(apErr.Error())
+			return apErr
+
+		case <-timer.C:
+			cmd.Process.Kill()
+			apErr := st.ap.fail(ApFailTimeout, 0, "no AP-ENABLED within "+timeout.String())
+			wpa.Log.Error(apErr.Error())
+			return apErr
+		}
+	}
+}
 
-			blocked = false
-			return
+// watchAP records hostapd exiting after a successful start, unless cmd
+// was stopped on purpose or replaced.
+func (wpa *WpaCfg) watchAP(cmd *exec.Cmd, exited chan error) {
+	err := <-exited
+	apErr := wpa.st().ap.exited(cmd, exitStatus(err), "hostapd exited")
+	if apErr == nil {
+		wpa.Log.Info("Hostapd stopped")
+		return
+	}
+	wpa.Log.Error(apErr.Error())
+}
 
-		}
-		if strings.Contains(out, "uap0: AP-ENABLED") {
-			wpa.Log.Info("Hostapd ENABLED")
-			blocked = false
-			return
+// exitStatus returns the exit status of a command from its Wait error.
+func exitStatus(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
 		}
 	}
+
+	return 0
 }
 
 // ConfiguredNetworks returns a list of configured wifi networks.
 func (wpa *WpaCfg) ConfiguredNetworks() string {
 	netOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan").Output()
 	if err != nil {
-		wpa.Log.Fatal(err)
+		wpa.Log.Error(err)
 	}
 
 	return string(netOut)
 }
 
+// SavedNetworks lists the networks saved in wpa_supplicant with their
+// priority.
+func (wpa *WpaCfg) SavedNetworks() ([]SavedNetwork, error) {
+	listOut, err := exec.Command("wpa_cli", "-i", "wlan0", "list_networks").Output()
+	if err != nil {
+		wpa.Log.Error("Could not list networks: %s", err.Error())
+		return nil, err
+	}
+
+	networks := parseListNetworks(listOut)
+	for i := range networks {
+		priority, err := exec.Command("wpa_cli", "-i", "wlan0", "get_network", networks[i].Id, "priority").Output()
+		if err == nil {
+			networks[i].Priority, _ = strconv.Atoi(strings.TrimSpace(string(priority)))
+		}
+	}
+
+	return networks, nil
+}
+
+// ForgetNetwork removes the saved networks with the id or ssid network
+// from wpa_supplicant and its configuration.
+func (wpa *WpaCfg) ForgetNetwork(network string) error {
+	wpa.st().station.Lock()
+	defer wpa.st().station.Unlock()
+
+	networks, err := wpa.SavedNetworks()
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, saved := range networks {
+		if saved.Id != network && saved.Ssid != network {
+			continue
+		}
+		removeOut, err := exec.Command("wpa_cli", "-i", "wlan0", "remove_network", saved.Id).Output()
+		if err == nil && strings.TrimSpace(string(removeOut)) == "FAIL" {
+			err = fmt.Errorf("wpa_cli remove_network %s: FAIL", saved.Id)
+		}
+		if err != nil {
+			return err
+		}
+		wpa.Log.Info(map[string]interface{}{"id": saved.Id, "ssid": saved.Ssid}, "WPA removed network")
+		removed++
+	}
+	if removed == 0 {
+		return fmt.Errorf("network %q is not saved", network)
+	}
+
+	saveOut, err := exec.Command("wpa_cli", "-i", "wlan0", "save_config").Output()
+	if err != nil {
+		return err
+	}
+	wpa.Log.Info("WPA save got: %s", strings.TrimSpace(string(saveOut)))
+
+	return nil
+}
+
 // ConnectNetwork connects to a wifi network
 func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 	connection := WpaConnection{}
 
+	wpa.st().station.Lock()
+	defer wpa.st().station.Unlock()
+
+	outcome, reason := "failure", "wpa_cli_error"
+	defer func() {
+		metricConnectAttempts.Inc(outcome, reason)
+	}()
+
 	// 1. Add a network
 	addNetOut, err := exec.Command("wpa_cli", "-i", "wlan0", "add_network").Output()
 	if err != nil {
-		wpa.Log.Fatal(err)
+		wpa.Log.Error(err)
 		return connection, err
 	}
 	net := strings.TrimSpace(string(addNetOut))
@@ -156,16 +347,27 @@ func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 	// 2. Set the ssid for the new network
 	addSsidOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "ssid", "\""+creds.Ssid+"\"").Output()
 	if err != nil {
-		wpa.Log.Fatal(err)
+		wpa.Log.Error(err)
 		return connection, err
 	}
 	ssidStatus := strings.TrimSpace(string(addSsidOut))
 	wpa.Log.Info("WPA add ssid got: %s", ssidStatus)
 
-	// 3. Set the psk for the new network
-	addPskOut, err := exec.Command("wpa_cli", "-i", "wlan0", "set_network", net, "psk", "\""+creds.Psk+"\"").Output()
+	// 3. Set the psk for the new network, unquoted when it is 64 hex
+	// digits, open networks have no key management
+	psk := "\"" + creds.Psk + "\""
+	if len(creds.Psk) == 64 {
+		if _, err := hex.DecodeString(creds.Psk); err == nil {
+			psk = creds.Psk
+		}
+	}
+	pskArgs := []string{"-i", "wlan0", "set_network", net, "psk", psk}
+	if creds.Psk == "" {
+		pskArgs = []string{"-i", "wlan0", "set_network", net, "key_mgmt", "NONE"}
+	}
+	addPskOut, err := exec.Command("wpa_cli", pskArgs...).Output()
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
+		wpa.Log.Error(err.Error())
 		return connection, err
 	}
 	pskStatus := strings.TrimSpace(string(addPskOut))
@@ -174,16 +376,16 @@ func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 	// 4. Enable the new network
 	enableOut, err := exec.Command("wpa_cli", "-i", "wlan0", "enable_network", net).Output()
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
+		wpa.Log.Error(err.Error())
 		return connection, err
 	}
 	enableStatus := strings.TrimSpace(string(enableOut))
 	wpa.Log.Info("WPA enable got: %s", enableStatus)
-	
+
 	// 5. Select the new network
 	selectOut, err := exec.Command("wpa_cli", "-i", "wlan0", "select_network", net).Output()
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
+		wpa.Log.Error(err.Error())
 		return connection, err
 	}
 	selectStatus := strings.TrimSpace(string(selectOut))
@@ -198,20 +400,21 @@ func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 
 		stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
 		if err != nil {
-			wpa.Log.Fatal("Got error checking state: %s", err.Error())
+			wpa.Log.Error("Got error checking state: %s", err.Error())
 			return connection, err
 		}
 		ms := rState.FindSubmatch(stateOut)
 
 		if len(ms) > 0 {
 			state := string(ms[1])
+			reason = strings.ToLower(state)
 			wpa.Log.Info("WPA Enable state: %s", state)
 			// see https://developer.android.com/reference/android/net/wifi/SupplicantState.html
 			if state == "COMPLETED" {
 				// save the config
 				saveOut, err := exec.Command("wpa_cli", "-i", "wlan0", "save_config").Output()
 				if err != nil {
-					wpa.Log.Fatal(err.Error())
+					wpa.Log.Error(err.Error())
 					return connection, err
 				}
 				saveStatus := strings.TrimSpace(string(saveOut))
@@ -219,6 +422,7 @@ func (wpa *WpaCfg) ConnectNetwork(creds WpaCredentials) (WpaConnection, error) {
 
 				connection.Ssid = creds.Ssid
 				connection.State = state
+				outcome = "success"
 
 				return connection, nil
 			}
@@ -238,12 +442,36 @@ func (wpa *WpaCfg) Status() (map[string]string, error) {
 
 	stateOut, err := exec.Command("wpa_cli", "-i", "wlan0", "status").Output()
 	if err != nil {
-		wpa.Log.Fatal("Got error checking state: %s", err.Error())
+		wpa.Log.Error("Got error checking state: %s", err.Error())
 		return cfgMap, err
 	}
 
 	cfgMap = cfgMapper(stateOut)
 
+	// RSSI, LINKSPEED, NOISE and FREQUENCY, FAIL when not associated
+	signalOut, err := exec.Command("wpa_cli", "-i", "wlan0", "signal_poll").Output()
+	if err == nil {
+		for k, v := range cfgMapper(signalOut) {
+			cfgMap[strings.ToLower(k)] = v
+		}
+	}
+
+	st := wpa.st()
+	apStateName, apErr := st.ap.get()
+	cfgMap["boot_phase"], _ = st.boot.get()
+	cfgMap["ap_state"] = apStateName
+	cfgMap["conn_state"] = st.conn.get().State
+	if remote, ok := st.remote.get(); ok {
+		cfgMap["cfg_from_cache"] = strconv.FormatBool(remote.FromCache)
+		if remote.Error != "" {
+			cfgMap["cfg_error"] = remote.Error
+		}
+	}
+	if apErr != nil {
+		cfgMap["ap_error"] = apErr.Error()
+		cfgMap["ap_error_reason"] = apErr.Reason
+	}
+
 	return cfgMap, nil
 }
 
@@ -264,12 +492,22 @@ func cfgMapper(data []byte) map[string]string {
 }
 
 // ScanNetworks returns a map of WpaNetwork data structures.
-func (wpa *WpaCfg) ScanNetworks() (map[string]WpaNetwork, error) {
-	wpaNetworks := make(map[string]WpaNetwork, 0)
+func (wpa *WpaCfg) ScanNetworks() (wpaNetworks map[string]WpaNetwork, err error) {
+	wpaNetworks = make(map[string]WpaNetwork, 0)
+
+	start := time.Now()
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		metricScans.Inc(outcome)
+		metricScanDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	scanOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan").Output()
 	if err != nil {
-		wpa.Log.Fatal(err.Error())
+		wpa.Log.Error(err.Error())
 		return wpaNetworks, err
 	}
 	scanOutClean := strings.TrimSpace(string(scanOut))
@@ -280,7 +518,7 @@ func (wpa *WpaCfg) ScanNetworks() (map[string]WpaNetwork, error) {
 	if scanOutClean == "OK" {
 		networkListOut, err := exec.Command("wpa_cli", "-i", "wlan0", "scan_results").Output()
 		if err != nil {
-			wpa.Log.Fatal(err.Error())
+			wpa.Log.Error(err.Error())
 			return wpaNetworks, err
 		}
 
@@ -3,210 +3,292 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
+	"context"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
 
 	"github.com/bhoriuchi/go-bunyan/bunyan"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/txn2/txwifi/api"
 	"github.com/txn2/txwifi/iotwifi"
+	"github.com/txn2/txwifi/iotwifi/bunyanlog"
+	"github.com/txn2/txwifi/webui"
 )
 
-// ApiReturn structures a message for returned API calls.
-type ApiReturn struct {
-	Status  string      `json:"status"`
-	Message string      `json:"message"`
-	Payload interface{} `json:"payload"`
-}
+// Listener settings.
+const (
+	httpReadWrite = "read-write"
+	httpReadOnly  = "read-only"
+	httpOff       = "off"
+	socketOff     = "off"
+)
 
 func main() {
 
+	// flags override the environment, which overrides the configuration
+	flagEnvs := map[string]string{
+		"cfg":          "IOTWIFI_CFG",
+		"port":         "IOTWIFI_PORT",
+		"static":       "IOTWIFI_STATIC",
+		"socket":       "IOTWIFI_SOCKET",
+		"socket_mode":  "IOTWIFI_SOCKET_MODE",
+		"socket_group": "IOTWIFI_SOCKET_GROUP",
+		"http":         "IOTWIFI_HTTP",
+		"timeout":      "IOTWIFI_TIMEOUT",
+	}
+	flag.String("cfg", "", "configuration file or url, JSON, YAML or TOML (IOTWIFI_CFG)")
+	flag.String("port", "", "HTTP port (IOTWIFI_PORT)")
+	flag.String("static", "", "directory replacing the setup UI (IOTWIFI_STATIC)")
+	flag.String("socket", "", "unix socket of the API, served and used by commands, off disables it (IOTWIFI_SOCKET)")
+	flag.String("socket_mode", "", "octal permissions of the socket, 0660 by default (IOTWIFI_SOCKET_MODE)")
+	flag.String("socket_group", "", "group name or id owning the socket (IOTWIFI_SOCKET_GROUP)")
+	flag.String("http", "", "HTTP listener: "+httpReadWrite+", "+httpReadOnly+" or "+httpOff+" (IOTWIFI_HTTP)")
+	flag.String("timeout", "", "how long commands wait for the daemon, 1m by default (IOTWIFI_TIMEOUT)")
+	for _, path := range iotwifi.CfgPaths() {
+		flagEnvs[path] = iotwifi.CfgEnvName(path)
+		flag.String(path, "", "overrides the "+path+" setting ("+iotwifi.CfgEnvName(path)+")")
+	}
+	flag.Usage = usage
+	flag.Parse()
+
+	// every configuration load applies the environment overrides, so set
+	// flags are passed on as their environment variables
+	flag.Visit(func(f *flag.Flag) {
+		os.Setenv(flagEnvs[f.Name], f.Value.String())
+	})
+
+	cfgUrl := setEnvIfEmpty("IOTWIFI_CFG", "cfg/wificfg.json")
+	port := setEnvIfEmpty("IOTWIFI_PORT", "8080")
+	staticDir := setEnvIfEmpty("IOTWIFI_STATIC", "")
+	socket := setEnvIfEmpty("IOTWIFI_SOCKET", "/var/run/txwifi/txwifi.sock")
+	socketMode := setEnvIfEmpty("IOTWIFI_SOCKET_MODE", "0660")
+	socketGroup := setEnvIfEmpty("IOTWIFI_SOCKET_GROUP", "")
+	httpMode := setEnvIfEmpty("IOTWIFI_HTTP", httpReadWrite)
+	timeout := setEnvIfEmpty("IOTWIFI_TIMEOUT", "1m")
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		// run the daemon below
+	case "validate-config":
+		// txwifi validate-config [-device] [cfg ...] checks configurations
+		// and exits
+		os.Exit(validateConfig(flag.Args()[1:], cfgUrl))
+	default:
+		// commands manage the running daemon over its socket
+		os.Exit(runCommand(flag.Args(), socket, timeout))
+	}
+
+	socketPerm, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil || socketPerm > 0777 {
+		fmt.Fprintf(os.Stderr, "IOTWIFI_SOCKET_MODE: %q is not octal permissions such as 0660\n", socketMode)
+		os.Exit(1)
+	}
+	switch httpMode {
+	case httpReadWrite, httpReadOnly, httpOff:
+	default:
+		fmt.Fprintf(os.Stderr, "IOTWIFI_HTTP: %q is not %s, %s or %s\n", httpMode, httpReadWrite, httpReadOnly, httpOff)
+		os.Exit(1)
+	}
+
+	setupCfg, err := iotwifi.LoadCfg(cfgUrl)
+	if err == nil {
+		err = setupCfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration %s:\n%s\n", cfgUrl, err.Error())
+		os.Exit(1)
+	}
+
+	logLevels, err := iotwifi.NewLogLevels(setupCfg.LogCfg)
+	if err != nil {
+		panic(err)
+	}
+
+	logSink, err := bunyanlog.NewSink(setupCfg.LogCfg, os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+
+	// logLevels filters by level so bunyan passes everything
 	logConfig := bunyan.Config{
 		Name:   "txwifi",
-		Stream: os.Stdout,
-		Level:  bunyan.LogLevelDebug,
+		Stream: logSink,
+		Level:  bunyan.LogLevelTrace,
 	}
 
-	blog, err := bunyan.CreateLogger(logConfig)
+	bunyanLog, err := bunyan.CreateLogger(logConfig)
 	if err != nil {
 		panic(err)
 	}
 
-	blog.Info("Starting IoT Wifi...")
+	logger := logLevels.Logger(bunyanlog.New(bunyanLog))
 
-	messages := make(chan iotwifi.CmdMessage, 1)
+	logger.Info("Starting IoT Wifi...")
 
-	cfgUrl := setEnvIfEmpty("IOTWIFI_CFG", "cfg/wificfg.json")
-	port := setEnvIfEmpty("IOTWIFI_PORT", "8080")
+	// one service for the configuration loaded above
+	svc := iotwifi.NewService(logger, setupCfg, iotwifi.WithCfgLocation(cfgUrl))
 
-	go iotwifi.RunWifi(blog, messages, cfgUrl)
-	wpacfg := iotwifi.NewWpaCfg(blog, cfgUrl)
+	// listen to kill messages
+	svc.Runner().HandleFunc("kill", func(cmsg iotwifi.CmdMessage) {
+		logger.Error("GOT KILL")
+		os.Exit(1)
+	})
 
-	apiPayloadReturn := func(w http.ResponseWriter, message string, payload interface{}) {
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: message,
-			Payload: payload,
-		}
-		ret, _ := json.Marshal(apiReturn)
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+	if err := svc.Start(context.Background()); err != nil {
+		panic(err)
 	}
 
-	// marshallPost populates a struct with json in post body
-	marshallPost := func(w http.ResponseWriter, r *http.Request, v interface{}) {
-		bytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			blog.Error(err)
-			return
+	// SIGHUP reloads the configuration
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := svc.Reload("sighup"); err != nil {
+				logger.Error("Could not reload config: %s", err.Error())
+			}
 		}
+	}()
 
-		defer r.Body.Close()
+	// REST API at the root, followed by the setup UI, replaced by the
+	// contents of IOTWIFI_STATIC when set
+	wifiApi := api.New(svc, api.WithLogLevels(logLevels))
+	r := mux.NewRouter()
+	wifiApi.Register(r)
+	r.PathPrefix("/").Handler(wifiApi.Logged(webui.Handler(staticDir)))
+	http.Handle("/", r)
 
-		decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+	// CORS
+	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Content-Length", "X-Requested-With", "Accept", "Origin"})
+	originsOk := handlers.AllowedOrigins([]string{"*"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
 
-		err = decoder.Decode(&v)
+	// full API for commands and other processes on the device, access
+	// is controlled by the permissions of the socket
+	if socket != socketOff {
+		listener, err := listenUnix(socket, os.FileMode(socketPerm), socketGroup)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			blog.Error(err)
-			return
+			logger.Error("Could not listen on %s: %s", socket, err.Error())
+		} else {
+			logger.Info("HTTP Listening on " + socket)
+			go http.Serve(listener, r)
 		}
 	}
 
-	// common error return from api
-	retError := func(w http.ResponseWriter, err error) {
-		apiReturn := &ApiReturn{
-			Status:  "FAIL",
-			Message: err.Error(),
-		}
-		ret, _ := json.Marshal(apiReturn)
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+	if httpMode == httpOff {
+		logger.Info("HTTP listener disabled")
+		select {}
 	}
 
-	// handle /status POSTs json in the form of iotwifi.WpaConnect
-	statusHandler := func(w http.ResponseWriter, r *http.Request) {
-
-		status, err := wpacfg.Status()
-		if err != nil {
-			blog.Error(err.Error())
-			return
-		}
-
-		apiPayloadReturn(w, "status", status)
+	// the network may only observe in read-only mode
+	handler := http.Handler(r)
+	if httpMode == httpReadOnly {
+		handler = wifiApi.ReadOnly(r)
 	}
 
-	// handle /connect POSTs json in the form of iotwifi.WpaConnect
-	connectHandler := func(w http.ResponseWriter, r *http.Request) {
-		var creds iotwifi.WpaCredentials
-		marshallPost(w, r, &creds)
+	// serve http
+	logger.Info("HTTP Listening on " + port + " " + httpMode)
+	http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(handler))
 
-		blog.Info("Connect Handler Got: ssid:|%s| psk:|%s|", creds.Ssid, creds.Psk)
+}
 
-		connection, err := wpacfg.ConnectNetwork(creds)
-		if err != nil {
-			blog.Error(err.Error())
-			return
-		}
+// validateConfig validates configuration files or urls, the configured
+// one if none are given, printing the invalid fields of each. The files
+// they refer to are checked with -device. It returns the exit status, 1
+// if any configuration is invalid.
+func validateConfig(args []string, fallback string) int {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	device := fs.Bool("device", false, "also check the files on this device, such as wpa_supplicant.conf")
+	cfgs, err := parseArgs(fs, args, 0, len(args))
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	if len(cfgs) == 0 {
+		cfgs = []string{fallback}
+	}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Connection",
-			Payload: connection,
+	status := 0
+	for _, cfg := range cfgs {
+		err := iotwifi.ValidateCfg(cfg, *device)
+		if err == nil {
+			fmt.Printf("%s: OK\n", cfg)
+			continue
 		}
 
-		ret, err := json.Marshal(apiReturn)
-		if err != nil {
-			retError(w, err)
-			return
+		status = 1
+		if fieldErrs, ok := err.(iotwifi.ValidationErrors); ok {
+			for _, fieldErr := range fieldErrs {
+				fmt.Printf("%s: %s\n", cfg, fieldErr.Error())
+			}
+			continue
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		fmt.Printf("%s: %s\n", cfg, err.Error())
 	}
 
-	// scan for wifi networks
-	scanHandler := func(w http.ResponseWriter, r *http.Request) {
-		blog.Info("Got Scan")
-		wpaNetworks, err := wpacfg.ScanNetworks()
-		if err != nil {
-			retError(w, err)
-			return
-		}
-
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Networks",
-			Payload: wpaNetworks,
-		}
+	return status
+}
 
-		ret, err := json.Marshal(apiReturn)
+// listenUnix listens on a unix socket with the permissions perm, owned by
+// group when set, replacing a socket left by a previous run. The socket is
+// created under a temporary name and renamed once its permissions are set
+// so it is never accessible with others.
+func listenUnix(path string, perm os.FileMode, group string) (net.Listener, error) {
+	gid := -1
+	if group != "" {
+		id, err := strconv.Atoi(group)
 		if err != nil {
-			retError(w, err)
-			return
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			id, _ = strconv.Atoi(g.Gid)
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
+		gid = id
 	}
 
-	// kill the application
-	killHandler := func(w http.ResponseWriter, r *http.Request) {
-		messages <- iotwifi.CmdMessage{Id: "kill"}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
 
-		apiReturn := &ApiReturn{
-			Status:  "OK",
-			Message: "Killing service.",
+	tmp := path + ".tmp"
+	for _, p := range []string{tmp, path} {
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(p)
 		}
-		ret, err := json.Marshal(apiReturn)
-		if err != nil {
-			retError(w, err)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(ret)
 	}
 
-	// common log middleware for api
-	logHandler := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			staticFields := make(map[string]interface{})
-			staticFields["remote"] = r.RemoteAddr
-			staticFields["method"] = r.Method
-			staticFields["url"] = r.RequestURI
-
-			blog.Info(staticFields, "HTTP")
-			next.ServeHTTP(w, r)
-		})
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
 	}
+	// the socket is removed under its final name
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
 
-	// setup router and middleware
-	r := mux.NewRouter()
-	r.Use(logHandler)
-
-	// set app routes
-	r.HandleFunc("/status", statusHandler)
-	r.HandleFunc("/connect", connectHandler).Methods("POST")
-	r.HandleFunc("/scan", scanHandler)
-	r.HandleFunc("/kill", killHandler)
-	http.Handle("/", r)
-
-	// CORS
-	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", "Content-Length", "X-Requested-With", "Accept", "Origin"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS", "DELETE"})
-
-	// serve http
-	blog.Info("HTTP Listening on " + port)
-	http.ListenAndServe(":"+port, handlers.CORS(originsOk, headersOk, methodsOk)(r))
+	err = os.Chmod(tmp, perm)
+	if err == nil && gid >= 0 {
+		err = os.Chown(tmp, -1, gid)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
 
+	return listener, nil
 }
 
 // getEnv gets an environment variable or sets a default if
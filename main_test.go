@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	gid := strconv.Itoa(os.Getgid())
+
+	tests := []struct {
+		name  string
+		perm  os.FileMode
+		group string
+		stale bool
+		err   bool
+	}{
+		{name: "mode", perm: 0660},
+		{name: "private", perm: 0600},
+		{name: "group id", perm: 0660, group: gid},
+		{name: "stale socket", perm: 0660, stale: true},
+		{name: "unknown group", perm: 0660, group: "no-such-group-txwifi", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "txwifi")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "run", "txwifi.sock")
+			if tt.stale {
+				stale, err := listenUnix(path, 0666, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				stale.Close()
+			}
+
+			// watch for the socket, clients must never see it before
+			// its mode and group are set
+			first := make(chan os.FileInfo, 1)
+			done := make(chan struct{})
+			go func() {
+				defer close(first)
+				for {
+					if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 && !tt.stale {
+						first <- fi
+						return
+					}
+					select {
+					case <-done:
+						return
+					default:
+					}
+				}
+			}()
+
+			listener, err := listenUnix(path, tt.perm, tt.group)
+			close(done)
+			if tt.err {
+				if err == nil {
+					listener.Close()
+					t.Fatal("got no error")
+				}
+				if _, err := os.Lstat(path + ".tmp"); !os.IsNotExist(err) {
+					t.Errorf("temporary socket left behind: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			fi, ok := <-first
+			if !ok {
+				if fi, err = os.Lstat(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if fi.Mode()&os.ModeSocket == 0 {
+				t.Errorf("got mode %s, want a socket", fi.Mode())
+			}
+			if fi.Mode().Perm() != tt.perm {
+				t.Errorf("got permissions %s, want %s", fi.Mode().Perm(), tt.perm)
+			}
+			if tt.group != "" {
+				if got := strconv.Itoa(int(fi.Sys().(*syscall.Stat_t).Gid)); got != tt.group {
+					t.Errorf("got group %s, want %s", got, tt.group)
+				}
+			}
+			if _, err := os.Lstat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temporary socket left behind: %v", err)
+			}
+		})
+	}
+}
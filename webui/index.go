@@ -0,0 +1,226 @@
+package webui
+
+// indexHTML is the self-contained setup page. It must not reference any
+// external assets. API paths are relative so the page keeps working when
+// the API is mounted under a path prefix.
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Wifi Setup</title>
+<style>
+* { box-sizing: border-box; }
+body { margin: 0; font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; background: #f2f4f7; color: #1d2329; }
+header { background: #1d2329; color: #fff; padding: 14px 16px; font-size: 18px; }
+main { max-width: 480px; margin: 0 auto; padding: 12px; }
+.card { background: #fff; border-radius: 8px; box-shadow: 0 1px 3px rgba(0,0,0,.12); margin-bottom: 12px; }
+.row { display: flex; align-items: center; padding: 14px 16px; border-bottom: 1px solid #e6e9ed; cursor: pointer; }
+.row:last-child { border-bottom: 0; }
+.row:active { background: #eef2f6; }
+.ssid { flex: 1; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+.icons { display: flex; align-items: center; gap: 8px; }
+.muted { color: #6b7785; font-size: 14px; padding: 14px 16px; }
+button { font-size: 16px; border: 0; border-radius: 6px; padding: 12px 16px; background: #2f6fde; color: #fff; width: 100%; }
+button.link { background: none; color: #2f6fde; width: auto; padding: 8px 0; }
+button:disabled { background: #9bb5e6; }
+input { font-size: 16px; width: 100%; padding: 12px; border: 1px solid #c7ced6; border-radius: 6px; margin: 8px 0 12px; }
+form { padding: 16px; }
+label { font-size: 14px; color: #6b7785; }
+.title { font-weight: 600; margin-bottom: 4px; word-break: break-all; }
+.spin { width: 28px; height: 28px; border: 3px solid #c7ced6; border-top-color: #2f6fde; border-radius: 50%; animation: spin 1s linear infinite; margin: 16px auto; }
+@keyframes spin { to { transform: rotate(360deg); } }
+.ok { color: #1e8a4c; }
+.fail { color: #c62b2b; }
+.center { text-align: center; padding: 16px; }
+.hidden { display: none; }
+</style>
+</head>
+<body>
+<header>Wifi Setup</header>
+<main>
+  <section id="list-view">
+    <div class="card" id="networks"><div class="muted">Scanning for networks&hellip;</div></div>
+    <button id="rescan">Scan again</button>
+  </section>
+
+  <section id="form-view" class="hidden">
+    <div class="card">
+      <form id="connect-form">
+        <div class="title" id="form-ssid"></div>
+        <div id="psk-group">
+          <label for="psk">Password</label>
+          <input id="psk" type="password" autocomplete="off" autocapitalize="off" spellcheck="false">
+        </div>
+        <button type="submit" id="connect">Connect</button>
+        <button type="button" class="link" id="cancel">Back</button>
+      </form>
+    </div>
+  </section>
+
+  <section id="progress-view" class="hidden">
+    <div class="card center">
+      <div class="title" id="progress-ssid"></div>
+      <div class="spin"></div>
+      <div class="muted" id="progress-state">Connecting&hellip;</div>
+    </div>
+  </section>
+
+  <section id="result-view" class="hidden">
+    <div class="card center">
+      <div class="title" id="result-title"></div>
+      <div class="muted" id="result-detail"></div>
+      <button id="done">OK</button>
+    </div>
+  </section>
+</main>
+<script>
+(function () {
+  "use strict";
+
+  var views = ["list-view", "form-view", "progress-view", "result-view"];
+  var selected = null;
+  var poller = null;
+
+  function $(id) { return document.getElementById(id); }
+
+  function show(view) {
+    views.forEach(function (v) { $(v).className = v === view ? "" : "hidden"; });
+  }
+
+  function api(method, path, body) {
+    var opts = { method: method, headers: {} };
+    if (body) {
+      opts.headers["Content-Type"] = "application/json";
+      opts.body = JSON.stringify(body);
+    }
+    return fetch(path, opts).then(function (res) { return res.json(); }).then(function (ret) {
+      if (ret.status !== "OK") { throw new Error(ret.message || "request failed"); }
+      return ret.payload;
+    });
+  }
+
+  function bars(level) {
+    var dbm = parseInt(level, 10), n = 0;
+    if (dbm >= -55) { n = 4; } else if (dbm >= -67) { n = 3; } else if (dbm >= -75) { n = 2; } else if (dbm >= -85) { n = 1; }
+    var svg = '<svg width="20" height="16" viewBox="0 0 20 16" aria-label="' + n + ' of 4 bars">';
+    for (var i = 0; i < 4; i++) {
+      var h = 4 + i * 4;
+      svg += '<rect x="' + (i * 5) + '" y="' + (16 - h) + '" width="3" height="' + h + '" rx="1" fill="' + (i < n ? "#1d2329" : "#c7ced6") + '"/>';
+    }
+    return svg + "</svg>";
+  }
+
+  function lock() {
+    return '<svg width="12" height="16" viewBox="0 0 12 16" aria-label="secured">' +
+      '<path d="M3 7V5a3 3 0 0 1 6 0v2" fill="none" stroke="#1d2329" stroke-width="2"/>' +
+      '<rect x="0" y="7" width="12" height="9" rx="2" fill="#1d2329"/></svg>';
+  }
+
+  function secured(net) { return /WPA|WEP|RSN/.test(net.flags || ""); }
+
+  // WPA takes 8 to 63 characters or 64 hex digits, WEP keys vary
+  function validKey(net, psk) {
+    if (!/WPA|RSN/.test(net.flags || "")) { return psk.length > 0; }
+    return (psk.length >= 8 && psk.length <= 63) || /^[0-9a-fA-F]{64}$/.test(psk);
+  }
+
+  function escapeHTML(s) {
+    return String(s).replace(/[&<>"']/g, function (c) {
+      return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+    });
+  }
+
+  function renderNetworks(payload) {
+    var nets = Object.keys(payload || {}).map(function (k) { return payload[k]; })
+      .filter(function (n) { return n.ssid; })
+      .sort(function (a, b) { return parseInt(b.signal_level, 10) - parseInt(a.signal_level, 10); });
+
+    var el = $("networks");
+    if (nets.length === 0) {
+      el.innerHTML = '<div class="muted">No networks found.</div>';
+      return;
+    }
+
+    el.innerHTML = "";
+    nets.forEach(function (net) {
+      var row = document.createElement("div");
+      row.className = "row";
+      row.innerHTML = '<div class="ssid">' + escapeHTML(net.ssid) + '</div>' +
+        '<div class="icons">' + (secured(net) ? lock() : "") + bars(net.signal_level) + '</div>';
+      row.onclick = function () { selectNetwork(net); };
+      el.appendChild(row);
+    });
+  }
+
+  function scan() {
+    $("rescan").disabled = true;
+    $("networks").innerHTML = '<div class="muted">Scanning for networks&hellip;</div>';
+    api("GET", "scan").then(renderNetworks).catch(function (err) {
+      $("networks").innerHTML = '<div class="muted fail">Scan failed: ' + escapeHTML(err.message) + '</div>';
+    }).then(function () { $("rescan").disabled = false; });
+  }
+
+  function selectNetwork(net) {
+    selected = net;
+    $("form-ssid").textContent = net.ssid;
+    $("psk").value = "";
+    $("psk-group").className = secured(net) ? "" : "hidden";
+    show("form-view");
+    if (secured(net)) { $("psk").focus(); }
+  }
+
+  function pollStatus() {
+    api("GET", "status").then(function (status) {
+      if (status && status.wpa_state) { $("progress-state").textContent = status.wpa_state.toLowerCase().replace(/_/g, " "); }
+    }).catch(function () {});
+  }
+
+  function result(ok, title, detail) {
+    clearInterval(poller);
+    $("result-title").className = "title " + (ok ? "ok" : "fail");
+    $("result-title").textContent = title;
+    $("result-detail").textContent = detail || "";
+    show("result-view");
+  }
+
+  function connect(ev) {
+    ev.preventDefault();
+    var psk = $("psk").value;
+    if (secured(selected) && !validKey(selected, psk)) {
+      $("psk").focus();
+      return;
+    }
+
+    $("progress-ssid").textContent = selected.ssid;
+    $("progress-state").textContent = "Connecting…";
+    show("progress-view");
+    poller = setInterval(pollStatus, 2000);
+
+    api("POST", "connect", { ssid: selected.ssid, psk: psk }).then(function (conn) {
+      if (conn.state !== "COMPLETED") {
+        result(false, "Could not connect", conn.message || ("Unable to connect to " + selected.ssid));
+        return;
+      }
+      return api("GET", "status").then(function (status) {
+        var ip = status.ip_address ? "IP address " + status.ip_address : "";
+        result(true, "Connected to " + selected.ssid, ip);
+      }, function () {
+        result(true, "Connected to " + selected.ssid);
+      });
+    }).catch(function (err) {
+      result(false, "Could not connect", err.message);
+    });
+  }
+
+  $("rescan").onclick = scan;
+  $("cancel").onclick = function () { show("list-view"); };
+  $("done").onclick = function () { show("list-view"); scan(); };
+  $("connect-form").onsubmit = connect;
+
+  scan();
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,40 @@
+// Package webui serves the default wifi setup page. The page is compiled
+// into the binary so it works from a phone connected to the setup AP,
+// which has no internet access and therefore no CDN.
+
+package webui
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// started is used as the modification time of the embedded page.
+var started = time.Now()
+
+// Handler returns an http.Handler serving the setup UI. If staticDir is
+// not empty and exists, files are served from it instead of the
+// embedded page, allowing a custom front-end to replace the default.
+func Handler(staticDir string) http.Handler {
+	if staticDir != "" {
+		if fi, err := os.Stat(staticDir); err == nil && fi.IsDir() {
+			return http.FileServer(http.Dir(staticDir))
+		}
+	}
+
+	return http.HandlerFunc(serveIndex)
+}
+
+// serveIndex writes the embedded setup page for / and /index.html.
+func serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", started, strings.NewReader(indexHTML))
+}